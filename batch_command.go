@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/config"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+type batchCommand struct {
+	ConfigFile string
+	Reports    cli.StringSlice
+
+	OdooClientId     string
+	OdooClientSecret string
+
+	Sink    sinkFlags
+	Retry   retryFlags
+	Metrics metricsFlags
+
+	DryRun       bool
+	DryRunOutput string
+
+	Ledger ledgerFlags
+
+	ContinueOnError bool
+	Concurrency     int
+
+	SampleErrorPolicy    string
+	SampleErrorThreshold float64
+
+	JsonnetLibraryPaths cli.StringSlice
+	JsonnetExtVars      stringList
+
+	BeginExpr       string
+	RepeatUntilExpr string
+	// now is the time relative expressions are resolved at. They are resolved per report, since the reports might have different alignments.
+	now time.Time
+
+	config config.Config
+}
+
+var batchCommandName = "batch"
+
+func newBatchCommand() *cli.Command {
+	command := &batchCommand{}
+	return &cli.Command{
+		Name:   batchCommandName,
+		Usage:  "Run multiple reports defined in a configuration file in the given period",
+		Before: command.before,
+		Action: command.execute,
+		Flags: slices.Concat([]cli.Flag{
+			&cli.StringFlag{Name: "config", Usage: "Path to the YAML or JSON file containing the connection settings and report definitions",
+				EnvVars: envVars("CONFIG"), Destination: &command.ConfigFile, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringSliceFlag{Name: "report", Usage: "Name of a report in the configuration file to run. Can be repeated. Runs all reports if not set.",
+				EnvVars: envVars("REPORTS"), Destination: &command.Reports, Required: false, DefaultText: "all"},
+			&cli.StringFlag{Name: "odoo-oauth-client-id", Usage: "Client ID of the oauth client to interact with Odoo metered billing API. Overrides the value from the configuration file.",
+				EnvVars: envVars("ODOO_OAUTH_CLIENT_ID"), Destination: &command.OdooClientId, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "odoo-oauth-client-secret", Usage: "Client secret of the oauth client to interact with Odoo metered billing API. Overrides the value from the configuration file.",
+				EnvVars: envVars("ODOO_OAUTH_CLIENT_SECRET"), Destination: &command.OdooClientSecret, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "begin", Usage: "Beginning timestamp of the report period " + timeExpressionUsage,
+				EnvVars: envVars("BEGIN"), Destination: &command.BeginExpr, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "repeat-until", Usage: "Repeat running the reports until reaching this timestamp " + timeExpressionUsage,
+				EnvVars: envVars("REPEAT_UNTIL"), Destination: &command.RepeatUntilExpr, Required: false, DefaultText: defaultTextForOptionalFlags},
+			newContinueOnErrorFlag(&command.ContinueOnError),
+			newConcurrencyFlag(&command.Concurrency),
+			newSampleErrorPolicyFlag(&command.SampleErrorPolicy),
+			newSampleErrorThresholdFlag(&command.SampleErrorThreshold),
+			newJsonnetLibPathFlag(&command.JsonnetLibraryPaths),
+			newJsonnetExtVarFlag(&command.JsonnetExtVars),
+			&cli.BoolFlag{Name: "dry-run", Usage: "Runs the reports without sending any records to Odoo. The request bodies are written to --dry-run-output instead. Webhook sinks can not be used in this mode.",
+				EnvVars: envVars("DRY_RUN"), Destination: &command.DryRun, Required: false, DefaultText: "false"},
+			&cli.StringFlag{Name: "dry-run-output", Usage: "File to write the request bodies to in dry-run mode, one JSON request body per line. Use '-' for stdout.", Value: "-",
+				EnvVars: envVars("DRY_RUN_OUTPUT"), Destination: &command.DryRunOutput, Required: false},
+		}, command.Retry.odooFlags(), command.Retry.promFlags(), command.Sink.flags(), command.Ledger.flags(), command.Metrics.flags()),
+	}
+}
+
+func (cmd *batchCommand) before(context *cli.Context) error {
+	cmd.now = time.Now()
+	for name, expr := range map[string]string{"begin": cmd.BeginExpr, "repeat-until": cmd.RepeatUntilExpr} {
+		if _, err := parseTimeFlag(name, expr, cmd.now, report.ReportArgs{}); err != nil {
+			return err
+		}
+	}
+
+	if cmd.DryRun && cmd.Ledger.File != "" {
+		return fmt.Errorf("--ledger can not be used with --dry-run, records would be recorded as delivered")
+	}
+	if cmd.DryRun && cmd.Sink.usesWebhook() {
+		return fmt.Errorf("webhook sinks can not be used with --dry-run, records would be sent to the webhook")
+	}
+
+	c, err := loadConfig(cmd.ConfigFile, cmd.OdooClientId, cmd.OdooClientSecret, !cmd.DryRun && cmd.Sink.usesOdoo())
+	if err != nil {
+		return err
+	}
+	cmd.config = c
+	return LogMetadata(context)
+}
+
+// loadConfig loads the configuration file and overrides the Odoo client credentials if set.
+// The Odoo settings are only validated if requireOdoo is set.
+func loadConfig(path, odooClientID, odooClientSecret string, requireOdoo bool) (config.Config, error) {
+	c, err := config.Load(path)
+	if err != nil {
+		return config.Config{}, err
+	}
+	if odooClientID != "" {
+		c.Odoo.OauthClientID = odooClientID
+	}
+	if odooClientSecret != "" {
+		c.Odoo.OauthClientSecret = odooClientSecret
+	}
+	if requireOdoo {
+		if err := c.ValidateOdoo(); err != nil {
+			return config.Config{}, fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (cmd *batchCommand) execute(cliCtx *cli.Context) (err error) {
+	ctx := cliCtx.Context
+	log := AppLogger(ctx).WithName(batchCommandName)
+
+	reports, err := cmd.config.Select(cmd.Reports.Value()...)
+	if err != nil {
+		return err
+	}
+
+	promClient, err := newPrometheusAPIClient(cmd.config.Prometheus.URL, cmd.config.Prometheus.ThanosAllowPartialResponses, cmd.config.Prometheus.OrgID)
+	if err != nil {
+		return fmt.Errorf("could not create prometheus client: %w", err)
+	}
+
+	grouping := map[string]string{}
+	if names := cmd.Reports.Value(); len(names) > 0 {
+		grouping["report"] = strings.Join(names, "+")
+	}
+	m, stopMetrics, err := cmd.Metrics.start(log, grouping)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	// All Odoo sinks share the dry-run client, so that concurrent writes to the output are serialized.
+	var dryRunClient *odoo.DryRunClient
+	if cmd.DryRun && cmd.Sink.usesOdoo() {
+		out, closeOut, openErr := openOutput(cmd.DryRunOutput)
+		if openErr != nil {
+			return fmt.Errorf("could not open dry-run output: %w", openErr)
+		}
+		defer closeOutput("dry-run output", closeOut, &err)
+		dryRunClient = odoo.NewDryRunClient(out, log,
+			odoo.WithMaxRecordsPerRequest(cmd.config.Odoo.MaxRecordsPerRequest),
+			odoo.WithMaxRequestBodySize(cmd.config.Odoo.MaxRequestBodySize),
+		)
+	}
+
+	extVars, err := parseJsonnetExtVars(cmd.JsonnetExtVars.Value())
+	if err != nil {
+		return err
+	}
+	libraryPaths := slices.Concat(cmd.config.JsonnetLibraryPaths, cmd.JsonnetLibraryPaths.Value())
+
+	l, err := cmd.Ledger.open()
+	if err != nil {
+		return err
+	}
+	odooClient, closeSinks, err := cmd.Sink.newSink(log, l, libraryPaths, extVars, func(endpoint config.Odoo) report.OdooClient {
+		o := endpoint.WithDefaults(cmd.config.Odoo)
+		if cmd.DryRun {
+			return dryRunClient
+		}
+		return odoo.NewOdooAPIClient(ctx, o.URL, o.OauthTokenURL, o.OauthClientID, o.OauthClientSecret, log,
+			cmd.Retry.odooOption(),
+			odoo.WithMaxRecordsPerRequest(o.MaxRecordsPerRequest),
+			odoo.WithMaxRequestBodySize(o.MaxRequestBodySize),
+			odoo.WithMetrics(m),
+		)
+	})
+	defer closeOutput("sinks", closeSinks, &err)
+	if err != nil {
+		return err
+	}
+
+	o := []report.Option{report.WithMetrics(m)}
+	if cmd.config.Prometheus.QueryTimeout != 0 {
+		o = append(o, report.WithPrometheusQueryTimeout(cmd.config.Prometheus.QueryTimeout))
+	}
+
+	if cmd.ContinueOnError {
+		o = append(o, report.WithContinueOnError())
+	}
+	if cmd.Concurrency > 1 {
+		o = append(o, report.WithConcurrency(cmd.Concurrency))
+	}
+	sampleErrorOptions, err := newSampleErrorOptions(cmd.SampleErrorPolicy, cmd.SampleErrorThreshold)
+	if err != nil {
+		return err
+	}
+	o = append(o, sampleErrorOptions...)
+
+	// A failing report should not prevent the other reports from running.
+	var errs error
+	for _, r := range reports {
+		args := r.ReportArgs()
+		args.JsonnetLibraryPaths = libraryPaths
+		args.JsonnetExtVars = mergeJsonnetExtVars(args.JsonnetExtVars, extVars)
+		rlog := log.WithValues("report", r.Name)
+		ro := slices.Concat(o, cmd.Retry.promOptions(rlog), []report.Option{newSampleErrorReporter(rlog)})
+		begin, _ := parseTimeFlag("begin", cmd.BeginExpr, cmd.now, args)
+		repeatUntil, _ := parseTimeFlag("repeat-until", cmd.RepeatUntilExpr, cmd.now, args)
+		if err := cmd.Ledger.checkBegin(*begin, cmd.now); err != nil {
+			log.Error(err, "Report failed", "report", r.Name)
+			errs = multierr.Append(errs, fmt.Errorf("report %q failed: %w", r.Name, err))
+			continue
+		}
+		if err := runReport(ctx, odooClient, promClient, args, *begin, repeatUntil, ro); err != nil {
+			log.Error(err, "Report failed", "report", r.Name)
+			errs = multierr.Append(errs, fmt.Errorf("report %q failed: %w", r.Name, err))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+
+	log.Info("Done")
+	return nil
+}
@@ -1,12 +1,30 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
 	"github.com/urfave/cli/v2"
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+	"github.com/appuio/appuio-reporting/pkg/retry"
+	"github.com/appuio/appuio-reporting/pkg/timeexpr"
 )
 
 const defaultTextForRequiredFlags = "<required>"
 const defaultTextForOptionalFlags = "<optional>"
 
+// retryJitter is the fraction by which retry backoffs are randomized.
+const retryJitter = 0.2
+
 func newPromURLFlag(destination *string) *cli.StringFlag {
 	return &cli.StringFlag{Name: "prom-url", Usage: "Prometheus connection URL in the form of http://host:port",
 		EnvVars: envVars("PROM_URL"), Destination: destination, Value: "http://localhost:9090"}
@@ -16,3 +34,359 @@ func newOdooURLFlag(destination *string) *cli.StringFlag {
 	return &cli.StringFlag{Name: "odoo-url", Usage: "URL of the Odoo Metered Billing API",
 		EnvVars: envVars("ODOO_URL"), Destination: destination, Value: "http://localhost:8080"}
 }
+
+// defaultLedgerRetention is how long entries are kept in the delivery ledger by default.
+const defaultLedgerRetention = 90 * 24 * time.Hour
+
+// ledgerFlags holds the flags to configure the delivery ledger.
+type ledgerFlags struct {
+	File      string
+	Retention time.Duration
+}
+
+func (f *ledgerFlags) flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "ledger", Usage: "Path to the delivery ledger. Records already delivered to a sink according to the ledger are skipped, delivered records are added to it. The file is created if it does not exist.",
+			EnvVars: envVars("LEDGER"), Destination: &f.File, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.DurationFlag{Name: "ledger-retention", Usage: "Entries of the delivery ledger with a timerange starting longer ago than this are pruned when records are added. Reports can not begin before the retention. 0 keeps all entries.",
+			EnvVars: envVars("LEDGER_RETENTION"), Destination: &f.Retention, Value: defaultLedgerRetention},
+	}
+}
+
+// open opens the delivery ledger. It returns nil if no ledger is configured.
+func (f *ledgerFlags) open() (*ledger.FileLedger, error) {
+	if f.File == "" {
+		return nil, nil
+	}
+	if f.Retention < 0 {
+		return nil, fmt.Errorf("--ledger-retention must not be negative, got %s", f.Retention)
+	}
+	return ledger.Open(f.File, ledger.WithRetention(f.Retention))
+}
+
+// checkBegin returns an error if a report beginning at begin could deliver records that have already been pruned from the ledger.
+// These records would be delivered again.
+func (f *ledgerFlags) checkBegin(begin, now time.Time) error {
+	if f.File == "" || f.Retention == 0 || !begin.Before(now.Add(-f.Retention)) {
+		return nil
+	}
+	return fmt.Errorf("begin %s is older than the ledger retention of %s, records pruned from the ledger would be delivered again. Increase --ledger-retention or set it to 0",
+		begin.Format(time.RFC3339), f.Retention)
+}
+
+func newContinueOnErrorFlag(destination *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{Name: "continue-on-error", Usage: "Continue a --repeat-until range after a failed report. A summary of the failed reports is logged at the end and the command exits non-zero if any report failed.",
+		EnvVars: envVars("CONTINUE_ON_ERROR"), Destination: destination, Required: false, DefaultText: "false"}
+}
+
+func newConcurrencyFlag(destination *int) *cli.IntFlag {
+	return &cli.IntFlag{Name: "concurrency", Usage: "Number of reports of a --repeat-until range to run in parallel",
+		EnvVars: envVars("CONCURRENCY"), Destination: destination, Value: 1}
+}
+
+func newOdooMaxRecordsPerRequestFlag(destination *int) *cli.IntFlag {
+	return &cli.IntFlag{Name: "odoo-max-records-per-request", Usage: "Maximum number of records sent to Odoo in a single request. Records are split into multiple requests if exceeded. 0 means unlimited.",
+		EnvVars: envVars("ODOO_MAX_RECORDS_PER_REQUEST"), Destination: destination, Value: 0}
+}
+
+func newOdooMaxRequestBodySizeFlag(destination *int) *cli.IntFlag {
+	return &cli.IntFlag{Name: "odoo-max-request-body-size", Usage: "Maximum size in bytes of a request body sent to Odoo. Records are split into multiple requests if exceeded. 0 means unlimited.",
+		EnvVars: envVars("ODOO_MAX_REQUEST_BODY_SIZE"), Destination: destination, Value: 0}
+}
+
+func newSampleErrorPolicyFlag(destination *string) *cli.StringFlag {
+	return &cli.StringFlag{Name: "sample-error-policy", Usage: fmt.Sprintf("How samples that could not be processed into records are handled. "+
+		"'%s' sends the valid records and fails the report, '%s' sends the valid records and logs a warning, '%s' fails the report without sending any records.",
+		report.SendAndFail, report.SendAndWarn, report.FailBeforeSend),
+		EnvVars: envVars("SAMPLE_ERROR_POLICY"), Destination: destination, Value: string(report.SendAndFail)}
+}
+
+func newSampleErrorThresholdFlag(destination *float64) *cli.Float64Flag {
+	return &cli.Float64Flag{Name: "sample-error-threshold", Usage: "Fail a report without sending any records if more than this percentage of samples could not be processed, regardless of --sample-error-policy. 0 disables the check.",
+		EnvVars: envVars("SAMPLE_ERROR_THRESHOLD"), Destination: destination, Value: 0}
+}
+
+// newSampleErrorOptions returns the report options for the given sample error policy and threshold.
+func newSampleErrorOptions(policy string, threshold float64) ([]report.Option, error) {
+	p, err := report.ParseSampleErrorPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	if threshold < 0 || threshold > 100 {
+		return nil, fmt.Errorf("sample error threshold must be between 0 and 100, got %g", threshold)
+	}
+	return []report.Option{report.WithSampleErrorPolicy(p), report.WithSampleErrorThreshold(threshold)}, nil
+}
+
+// newSampleErrorReporter returns a report option logging samples that could not be processed as a warning.
+func newSampleErrorReporter(log logr.Logger) report.Option {
+	return report.WithSampleErrorReporter(func(e report.SampleErrors) {
+		log.Info("Warning: some samples could not be processed, sent the records of the valid samples",
+			"timestamp", e.Timestamp.Format(time.RFC3339),
+			"failed", e.Failed,
+			"total", e.Total,
+			"error", e.Err.Error(),
+		)
+	})
+}
+
+func newProductIDJsonnetFlag(destination *string) *cli.StringFlag {
+	return &cli.StringFlag{Name: "product-id-jsonnet", Usage: "Jsonnet snippet that generates the Odoo Product ID of each sample. Takes precedence over --product-id.",
+		EnvVars: envVars("PRODUCT_ID_JSONNET"), Destination: destination, DefaultText: defaultTextForOptionalFlags}
+}
+
+func newUnitIDJsonnetFlag(destination *string) *cli.StringFlag {
+	return &cli.StringFlag{Name: "unit-id-jsonnet", Usage: "Jsonnet snippet that generates the ID of the unit to use in Odoo for each sample. Takes precedence over --unit-id.",
+		EnvVars: envVars("UNIT_ID_JSONNET"), Destination: destination, DefaultText: defaultTextForOptionalFlags}
+}
+
+// requireIDFlags returns an error if the product or unit ID is neither given statically nor computed by Jsonnet.
+func requireIDFlags(c *cli.Context, args report.ReportArgs) error {
+	required := make([]string, 0, 2)
+	if args.ProductIDJsonnet == "" {
+		required = append(required, "product-id")
+	}
+	if args.UnitIDJsonnet == "" {
+		required = append(required, "unit-id")
+	}
+	return requireFlags(c, required...)
+}
+
+// alignmentFlags holds the flags to configure where the timeranges of a report start.
+type alignmentFlags struct {
+	Alignment string
+	Timezone  string
+}
+
+func (f *alignmentFlags) flags() []cli.Flag {
+	names := make([]string, len(report.Alignments))
+	for i, a := range report.Alignments {
+		names[i] = string(a)
+	}
+	return []cli.Flag{
+		&cli.StringFlag{Name: "alignment", Usage: fmt.Sprintf("Where the timeranges start, one of %s. "+
+			"'auto' aligns to days if the timerange is a multiple of 24h, to hours if it is a multiple of an hour and to multiples of the timerange otherwise. "+
+			"With 'month', each timerange spans one calendar month and --timerange is not required.", strings.Join(names, ", ")),
+			EnvVars: envVars("ALIGNMENT"), Destination: &f.Alignment, Value: string(report.AlignAuto)},
+		&cli.StringFlag{Name: "timezone", Usage: "Timezone of day and month boundaries (example: Europe/Zurich)",
+			EnvVars: envVars("TIMEZONE"), Destination: &f.Timezone, Value: "UTC"},
+	}
+}
+
+func (f *alignmentFlags) apply(args *report.ReportArgs) error {
+	a, err := report.ParseAlignment(f.Alignment)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	args.Alignment = a
+	args.Location = loc
+	if err := args.CheckTimerange(); err != nil {
+		return fmt.Errorf("invalid --timerange: %w", err)
+	}
+	return nil
+}
+
+// salesOrderFlags holds the flags to configure where the sales order ID of a sample is taken from.
+type salesOrderFlags struct {
+	Labels        cli.StringSlice
+	Jsonnet       string
+	DebugOverride string
+}
+
+func (f *salesOrderFlags) flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{Name: "sales-order-label", Usage: "Label the sales order ID is taken from. Can be repeated, the labels are tried in order.",
+			EnvVars: envVars("SALES_ORDER_LABELS"), Destination: &f.Labels, DefaultText: report.SalesOrderLabel},
+		&cli.StringFlag{Name: "sales-order-jsonnet", Usage: "Jsonnet snippet that generates the sales order ID. Takes precedence over --sales-order-label.",
+			EnvVars: envVars("SALES_ORDER_JSONNET"), Destination: &f.Jsonnet, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "debug-override-sales-order-id", Usage: "Overrides the sales order ID to a static constant for debugging purposes. Shorthand for a --sales-order-jsonnet returning the constant.", Value: "",
+			EnvVars: envVars("DEBUG_OVERRIDE_SALES_ORDER_ID"), Destination: &f.DebugOverride, Required: false, DefaultText: "empty"},
+	}
+}
+
+// apply sets the sales order source of the report arguments.
+func (f *salesOrderFlags) apply(args *report.ReportArgs) error {
+	args.SalesOrderLabels = f.Labels.Value()
+	args.SalesOrderJsonnet = f.Jsonnet
+	if f.DebugOverride == "" {
+		return nil
+	}
+	if f.Jsonnet != "" {
+		return fmt.Errorf("only one of --sales-order-jsonnet and --debug-override-sales-order-id can be set")
+	}
+	// A JSON string is a valid Jsonnet string literal.
+	literal, err := json.Marshal(f.DebugOverride)
+	if err != nil {
+		return err
+	}
+	args.SalesOrderJsonnet = string(literal)
+	return nil
+}
+
+// requireFlags returns an error listing all given flags that have not been set.
+// It can be used for flags that are only required depending on the value of other flags.
+func requireFlags(c *cli.Context, names ...string) error {
+	missing := make([]string, 0, len(names))
+	for _, name := range names {
+		if c.String(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Required flags %q not set", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// stringList holds the values of a flag that can be repeated.
+// Unlike cli.StringSlice, the values are not split on commas, so that they can contain JSON or free text.
+// An environment variable holds a single value.
+type stringList []string
+
+// Set adds a value.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+// Value returns the values in the order they were given.
+func (l *stringList) Value() []string {
+	return *l
+}
+
+// timeExpressionUsage describes the expressions accepted by parseTimeFlag.
+const timeExpressionUsage = "in the form of RFC3339 (" + time.RFC3339 + ") or as relative expression like now/h-3h, start-of-last-month or end-of-last-month. " +
+	"Days and months of relative expressions are in the timezone of the report. " +
+	"Relative expressions are truncated to the alignment of the report"
+
+// parseTimeFlag resolves the time expression given with the flag in the timezone of the report, see timeexpr.ParseInLocation.
+// Relative expressions are truncated to the alignment of the report, so that "now-3h" refers to the last full hour minus 3 hours for hourly reports.
+// Returns nil if the expression is empty.
+func parseTimeFlag(name, expr string, now time.Time, args report.ReportArgs) (*time.Time, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	loc := args.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t, err := timeexpr.ParseInLocation(expr, now, loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s: %w", name, err)
+	}
+	if !timeexpr.IsAbsolute(expr) {
+		t = args.AlignDown(t)
+	}
+	return &t, nil
+}
+
+// openOutput opens the given file for writing, truncating it if it exists.
+// The path '-' refers to stdout, which is not closed by the returned close function.
+func openOutput(path string) (io.Writer, func() error, error) {
+	if path == "-" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// appendOutput opens the given file for appending, creating it if it does not exist.
+// empty reports whether the file was empty, so that headers are only written once.
+// The path '-' refers to stdout, which is always considered empty and not closed by the returned close function.
+func appendOutput(path string) (out io.Writer, empty bool, closeOut func() error, err error) {
+	if path == "-" {
+		return os.Stdout, true, func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, nil, multierr.Append(err, f.Close())
+	}
+	return f, info.Size() == 0, f.Close, nil
+}
+
+// closeOutput calls the close function returned by openOutput or appendOutput.
+// The close error is stored in err unless err is already set, so that incomplete writes are not silently ignored.
+func closeOutput(name string, closeOut func() error, err *error) {
+	if cerr := closeOut(); cerr != nil && *err == nil {
+		*err = fmt.Errorf("could not close %s: %w", name, cerr)
+	}
+}
+
+// retryFlags holds the flags to configure how sending records to Odoo and Prometheus queries are retried.
+type retryFlags struct {
+	OdooMaxRetries          int
+	OdooRetryInitialBackoff time.Duration
+	OdooRetryMaxBackoff     time.Duration
+
+	PromMaxRetries          int
+	PromRetryInitialBackoff time.Duration
+	PromRetryMaxBackoff     time.Duration
+}
+
+func (f *retryFlags) odooFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{Name: "odoo-max-retries", Usage: "Number of times sending records to Odoo is retried on transport errors, 5xx and 429 responses",
+			EnvVars: envVars("ODOO_MAX_RETRIES"), Destination: &f.OdooMaxRetries, Value: 3},
+		&cli.DurationFlag{Name: "odoo-retry-initial-backoff", Usage: "Time to wait before the first retry when sending records to Odoo. Doubles with every further retry. A Retry-After header from Odoo takes precedence, up to --odoo-retry-max-backoff.",
+			EnvVars: envVars("ODOO_RETRY_INITIAL_BACKOFF"), Destination: &f.OdooRetryInitialBackoff, Value: time.Second},
+		&cli.DurationFlag{Name: "odoo-retry-max-backoff", Usage: "Maximum time to wait between two retries when sending records to Odoo",
+			EnvVars: envVars("ODOO_RETRY_MAX_BACKOFF"), Destination: &f.OdooRetryMaxBackoff, Value: time.Minute},
+	}
+}
+
+func (f *retryFlags) promFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{Name: "prom-max-retries", Usage: "Number of times a Prometheus query is retried on server errors, timeouts and network errors",
+			EnvVars: envVars("PROM_MAX_RETRIES"), Destination: &f.PromMaxRetries, Value: 3},
+		&cli.DurationFlag{Name: "prom-retry-initial-backoff", Usage: "Time to wait before the first retry of a Prometheus query. Doubles with every further retry.",
+			EnvVars: envVars("PROM_RETRY_INITIAL_BACKOFF"), Destination: &f.PromRetryInitialBackoff, Value: time.Second},
+		&cli.DurationFlag{Name: "prom-retry-max-backoff", Usage: "Maximum time to wait between two retries of a Prometheus query",
+			EnvVars: envVars("PROM_RETRY_MAX_BACKOFF"), Destination: &f.PromRetryMaxBackoff, Value: 30 * time.Second},
+	}
+}
+
+// odooOption returns the Odoo client option retrying failed requests.
+func (f *retryFlags) odooOption() odoo.Option {
+	return odoo.WithRetryPolicy(newRetryPolicy(f.OdooMaxRetries, f.OdooRetryInitialBackoff, f.OdooRetryMaxBackoff))
+}
+
+// promOptions returns the report options retrying failed Prometheus queries and logging the retries.
+func (f *retryFlags) promOptions(log logr.Logger) []report.Option {
+	return []report.Option{
+		report.WithPrometheusQueryRetry(newRetryPolicy(f.PromMaxRetries, f.PromRetryInitialBackoff, f.PromRetryMaxBackoff)),
+		report.WithQueryRetryReporter(func(r report.QueryRetry) {
+			log.Info("Prometheus query failed, retrying",
+				"timestamp", r.Timestamp.Format(time.RFC3339),
+				"attempt", r.Attempt,
+				"maxAttempts", f.PromMaxRetries+1,
+				"backoff", r.Backoff.Round(time.Millisecond),
+				"error", r.Err.Error(),
+			)
+		}),
+	}
+}
+
+// newRetryPolicy returns a retry policy with exponential backoff and jitter.
+func newRetryPolicy(maxRetries int, initialBackoff, maxBackoff time.Duration) retry.Policy {
+	return retry.Policy{
+		MaxRetries:     maxRetries,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+		Jitter:         retryJitter,
+	}
+}
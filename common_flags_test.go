@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+func TestParseTimeFlag_LastMonthInTimezoneWestOfUTC(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	args := report.ReportArgs{Alignment: report.AlignMonth, Location: newYork}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	begin, err := parseTimeFlag("begin", "start-of-last-month", now, args)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2026, 9, 1, 0, 0, 0, 0, newYork).UTC(), *begin)
+
+	until, err := parseTimeFlag("repeat-until", "end-of-last-month", now, args)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, newYork).UTC(), *until)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/appuio/appuio-reporting/pkg/config"
+	"github.com/appuio/appuio-reporting/pkg/coverage"
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+const (
+	// gapsExitCodeFound is the exit code of the gaps command if missing or duplicated records were found.
+	gapsExitCodeFound = 1
+	// gapsExitCodeError is the exit code of the gaps command if the check itself failed, for example because Prometheus could not be queried.
+	gapsExitCodeError = 2
+)
+
+type gapsCommand struct {
+	ConfigFile string
+	Report     string
+	ProductID  string
+	Delivered  string
+	LedgerSink string
+
+	BeginExpr string
+	UntilExpr string
+	Begin     time.Time
+	Until     time.Time
+
+	EmitCommands bool
+
+	JsonnetLibraryPaths cli.StringSlice
+	JsonnetExtVars      stringList
+
+	config config.Config
+	args   report.ReportArgs
+	source coverage.Source
+}
+
+var gapsCommandName = "gaps"
+
+func newGapsCommand() *cli.Command {
+	command := &gapsCommand{}
+	return &cli.Command{
+		Name:  gapsCommandName,
+		Usage: "List timeranges of a report that have not been delivered or have been delivered more than once",
+		Description: fmt.Sprintf("Runs the query of the report for each timerange between --begin and --until and compares the records with the records in --delivered. "+
+			"Exits with %d if all records have been delivered exactly once, with %d if missing or duplicated records were found and with %d if the check failed.",
+			0, gapsExitCodeFound, gapsExitCodeError),
+		Before: command.before,
+		Action: command.execute,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config", Usage: "Path to the YAML or JSON file containing the connection settings and report definitions",
+				EnvVars: envVars("CONFIG"), Destination: &command.ConfigFile, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "report", Usage: "Name of the report in the configuration file to check",
+				EnvVars: envVars("REPORT"), Destination: &command.Report, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "delivered", Usage: "Where to read the delivered records from. " +
+				"Values: 'ledger=<path>' for a delivery ledger, 'jsonl=<path>' or 'csv=<path>' for files written by the sinks of the same name, 'odoo' or 'odoo=<url>' for the Odoo Metered Billing API (not supported by the API yet). " +
+				"CSV files must be written with --csv-header and contain the product_id, instance_id, sales_order_id, timerange_from and timerange_to columns.",
+				EnvVars: envVars("DELIVERED"), Destination: &command.Delivered, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "ledger-sink", Usage: "Sink whose deliveries are read from a delivery ledger, as passed to --sink when running the reports",
+				EnvVars: envVars("LEDGER_SINK"), Destination: &command.LedgerSink, Value: ledger.DefaultSink},
+			&cli.StringFlag{Name: "product-id", Usage: "Only check records of this Odoo Product ID. Checks all products of the report if not set.",
+				EnvVars: envVars("PRODUCT_ID"), Destination: &command.ProductID, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "begin", Usage: "Beginning timestamp of the checked period " + timeExpressionUsage,
+				EnvVars: envVars("BEGIN"), Destination: &command.BeginExpr, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "until", Usage: "End of the checked period " + timeExpressionUsage,
+				EnvVars: envVars("UNTIL"), Destination: &command.UntilExpr, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.BoolFlag{Name: "emit-commands", Usage: "Print the batch commands delivering the missing records instead of the list of timeranges",
+				EnvVars: envVars("EMIT_COMMANDS"), Destination: &command.EmitCommands, DefaultText: "false"},
+			newJsonnetLibPathFlag(&command.JsonnetLibraryPaths),
+			newJsonnetExtVarFlag(&command.JsonnetExtVars),
+		},
+	}
+}
+
+func (cmd *gapsCommand) before(context *cli.Context) error {
+	c, err := loadConfig(cmd.ConfigFile, "", "", false)
+	if err != nil {
+		return err
+	}
+	selected, err := c.Select(cmd.Report)
+	if err != nil {
+		return err
+	}
+	extVars, err := parseJsonnetExtVars(cmd.JsonnetExtVars.Value())
+	if err != nil {
+		return err
+	}
+	cmd.config = c
+	cmd.args = selected[0].ReportArgs()
+	cmd.args.JsonnetLibraryPaths = slices.Concat(c.JsonnetLibraryPaths, cmd.JsonnetLibraryPaths.Value())
+	cmd.args.JsonnetExtVars = mergeJsonnetExtVars(cmd.args.JsonnetExtVars, extVars)
+
+	now := time.Now()
+	begin, err := parseTimeFlag("begin", cmd.BeginExpr, now, cmd.args)
+	if err != nil {
+		return err
+	}
+	if err := cmd.args.CheckAlignment(*begin); err != nil {
+		return fmt.Errorf("invalid --begin: %w", err)
+	}
+	until, err := parseTimeFlag("until", cmd.UntilExpr, now, cmd.args)
+	if err != nil {
+		return err
+	}
+	if !until.After(*begin) {
+		return fmt.Errorf("--until must be after --begin")
+	}
+	cmd.Begin, cmd.Until = *begin, *until
+
+	if cmd.source, err = cmd.newSource(); err != nil {
+		return err
+	}
+	return LogMetadata(context)
+}
+
+// newSource returns the source of the delivered records configured with --delivered.
+func (cmd *gapsCommand) newSource() (coverage.Source, error) {
+	kind, path, hasPath := strings.Cut(cmd.Delivered, "=")
+	if kind == odooSinkName {
+		if !hasPath {
+			path = cmd.config.Odoo.URL
+		}
+		return coverage.OdooSource{URL: path}, nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("--delivered %q requires a path, e.g. %s=records.%s", cmd.Delivered, kind, kind)
+	}
+	switch kind {
+	case "ledger":
+		l, err := openExistingLedger(path)
+		if err != nil {
+			return nil, err
+		}
+		return coverage.LedgerSource{Ledger: l, Sink: cmd.LedgerSink}, nil
+	case "jsonl":
+		return coverage.FileSource{Path: path, Read: coverage.ReadJSONL}, nil
+	case "csv":
+		return coverage.FileSource{Path: path, Read: coverage.ReadCSV}, nil
+	}
+	return nil, fmt.Errorf("unknown --delivered %q", cmd.Delivered)
+}
+
+func (cmd *gapsCommand) execute(cliCtx *cli.Context) error {
+	ctx := cliCtx.Context
+	log := AppLogger(ctx).WithName(gapsCommandName)
+
+	delivered, err := cmd.source.Delivered(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("could not read delivered records: %w", err), gapsExitCodeError)
+	}
+
+	promClient, err := newPrometheusAPIClient(cmd.config.Prometheus.URL, cmd.config.Prometheus.ThanosAllowPartialResponses, cmd.config.Prometheus.OrgID)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("could not create prometheus client: %w", err), gapsExitCodeError)
+	}
+	var o []report.Option
+	if cmd.config.Prometheus.QueryTimeout != 0 {
+		o = append(o, report.WithPrometheusQueryTimeout(cmd.config.Prometheus.QueryTimeout))
+	}
+
+	log.Info("Checking timeranges...", "report", cmd.Report, "begin", cmd.Begin.Format(time.RFC3339), "until", cmd.Until.Format(time.RFC3339))
+	timeranges, err := coverage.Check(ctx, promClient, cmd.args, delivered, cmd.ProductID, cmd.Begin, cmd.Until, o...)
+	if err != nil {
+		return cli.Exit(err, gapsExitCodeError)
+	}
+
+	counts := make(map[coverage.Status]int)
+	for _, t := range timeranges {
+		counts[t.Status()]++
+	}
+	log.Info(fmt.Sprintf("Checked %d timeranges", len(timeranges)),
+		"complete", counts[coverage.Complete],
+		"missing", counts[coverage.Missing],
+		"partial", counts[coverage.Partial],
+		"duplicated", counts[coverage.Duplicated],
+	)
+
+	out := cliCtx.App.Writer
+	if cmd.EmitCommands {
+		err = cmd.printCommands(out, coverage.Gaps(timeranges))
+	} else {
+		err = printTimeranges(out, timeranges)
+	}
+	if err != nil {
+		return cli.Exit(err, gapsExitCodeError)
+	}
+
+	if counts[coverage.Complete] < len(timeranges) {
+		return cli.Exit(fmt.Sprintf("%d timeranges not delivered exactly once", len(timeranges)-counts[coverage.Complete]), gapsExitCodeFound)
+	}
+	return nil
+}
+
+// printTimeranges writes the timeranges that have not been delivered exactly once as a table.
+func printTimeranges(out io.Writer, timeranges []coverage.Timerange) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FROM\tTO\tSTATUS\tEXPECTED\tDELIVERED\tMISSING\tDUPLICATED")
+	for _, t := range timeranges {
+		if t.Status() == coverage.Complete {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			t.From.Format(time.RFC3339),
+			t.To.Format(time.RFC3339),
+			t.Status(),
+			t.Expected,
+			t.Delivered,
+			t.Missing,
+			t.Duplicated,
+		)
+	}
+	return w.Flush()
+}
+
+// printCommands writes one batch command per gap.
+// If the records were read from a ledger, the commands use the same ledger and sink so that already delivered records of partially delivered timeranges are skipped.
+func (cmd *gapsCommand) printCommands(out io.Writer, gaps []coverage.Range) error {
+	for _, g := range gaps {
+		args := []string{appName, batchCommandName,
+			"--config", cmd.ConfigFile,
+			"--report", cmd.Report,
+			"--begin", g.From.Format(time.RFC3339),
+			"--repeat-until", g.To.Format(time.RFC3339),
+		}
+		if kind, path, _ := strings.Cut(cmd.Delivered, "="); kind == "ledger" {
+			args = append(args, "--ledger", path)
+			if cmd.LedgerSink != ledger.DefaultSink {
+				args = append(args, "--sink", cmd.LedgerSink)
+			}
+		}
+		for _, p := range cmd.JsonnetLibraryPaths.Value() {
+			args = append(args, "--jsonnet-lib-path", p)
+		}
+		for _, v := range cmd.JsonnetExtVars.Value() {
+			args = append(args, "--jsonnet-ext-var", v)
+		}
+		for i, a := range args {
+			args[i] = shellQuote(a)
+		}
+		if _, err := fmt.Fprintln(out, strings.Join(args, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes the argument for POSIX shells if it contains special characters.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
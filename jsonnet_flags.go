@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+// jsonnetSnippets are the flags of Jsonnet snippets that can also be read from a file, and the report arguments they set.
+var jsonnetSnippets = []struct {
+	flag  string
+	field func(*report.ReportArgs) *string
+}{
+	{"instance-jsonnet", func(a *report.ReportArgs) *string { return &a.InstanceJsonnet }},
+	{"item-group-description-jsonnet", func(a *report.ReportArgs) *string { return &a.ItemGroupDescriptionJsonnet }},
+	{"item-description-jsonnet", func(a *report.ReportArgs) *string { return &a.ItemDescriptionJsonnet }},
+	{"sales-order-jsonnet", func(a *report.ReportArgs) *string { return &a.SalesOrderJsonnet }},
+	{"product-id-jsonnet", func(a *report.ReportArgs) *string { return &a.ProductIDJsonnet }},
+	{"unit-id-jsonnet", func(a *report.ReportArgs) *string { return &a.UnitIDJsonnet }},
+}
+
+// jsonnetFlags holds the flags to read Jsonnet snippets from files and to configure the Jsonnet library paths.
+type jsonnetFlags struct {
+	LibraryPaths cli.StringSlice
+	ExtVars      stringList
+	files        []string
+}
+
+func (f *jsonnetFlags) flags() []cli.Flag {
+	f.files = make([]string, len(jsonnetSnippets))
+	flags := []cli.Flag{newJsonnetLibPathFlag(&f.LibraryPaths), newJsonnetExtVarFlag(&f.ExtVars)}
+	for i, s := range jsonnetSnippets {
+		flags = append(flags, &cli.StringFlag{Name: s.flag + "-file", Usage: fmt.Sprintf("File to read --%s from", s.flag),
+			EnvVars: envVars(strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_")) + "_FILE"), Destination: &f.files[i], DefaultText: defaultTextForOptionalFlags})
+	}
+	return flags
+}
+
+// apply reads the snippet files into the report arguments and sets the Jsonnet library paths.
+func (f *jsonnetFlags) apply(args *report.ReportArgs) error {
+	args.JsonnetLibraryPaths = f.LibraryPaths.Value()
+	extVars, err := parseJsonnetExtVars(f.ExtVars.Value())
+	if err != nil {
+		return err
+	}
+	args.JsonnetExtVars = extVars
+	for i, s := range jsonnetSnippets {
+		if f.files[i] == "" {
+			continue
+		}
+		dest := s.field(args)
+		if *dest != "" {
+			return fmt.Errorf("only one of --%s and --%s-file can be set", s.flag, s.flag)
+		}
+		raw, err := os.ReadFile(f.files[i])
+		if err != nil {
+			return fmt.Errorf("failed to read --%s-file: %w", s.flag, err)
+		}
+		*dest = string(raw)
+	}
+	return nil
+}
+
+func newJsonnetLibPathFlag(destination *cli.StringSlice) *cli.StringSliceFlag {
+	return &cli.StringSliceFlag{Name: "jsonnet-lib-path", Usage: "Directory searched for files imported by the Jsonnet snippets. Can be repeated.",
+		EnvVars: envVars("JSONNET_LIB_PATHS"), Destination: destination, DefaultText: defaultTextForOptionalFlags}
+}
+
+// requireInstanceJsonnet returns an error if the instance Jsonnet has neither been given inline nor as file.
+func requireInstanceJsonnet(args report.ReportArgs) error {
+	if args.InstanceJsonnet == "" {
+		return fmt.Errorf(`Required flag "instance-jsonnet" or "instance-jsonnet-file" not set`)
+	}
+	return nil
+}
+
+func newJsonnetExtVarFlag(destination *stringList) *cli.GenericFlag {
+	return &cli.GenericFlag{Name: "jsonnet-ext-var", Usage: fmt.Sprintf("External variable available to the Jsonnet snippets, as key=value. The value can contain commas. Can be repeated. "+
+		"The variables %s are always set.", strings.Join(report.ReservedExtVars, ", ")),
+		EnvVars: envVars("JSONNET_EXT_VARS"), Value: destination, DefaultText: defaultTextForOptionalFlags}
+}
+
+// parseJsonnetExtVars parses external variables given as key=value.
+func parseJsonnetExtVars(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	extVars := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid jsonnet ext var %q, expected key=value", v)
+		}
+		if slices.Contains(report.ReservedExtVars, key) {
+			return nil, fmt.Errorf("jsonnet ext var %q is reserved", key)
+		}
+		extVars[key] = value
+	}
+	return extVars, nil
+}
+
+// mergeJsonnetExtVars returns the external variables of a report from the configuration file, overridden by the ones given with flags.
+func mergeJsonnetExtVars(fromConfig, fromFlags map[string]string) map[string]string {
+	merged := maps.Clone(fromConfig)
+	if merged == nil {
+		merged = make(map[string]string, len(fromFlags))
+	}
+	maps.Copy(merged, fromFlags)
+	return merged
+}
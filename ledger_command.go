@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+)
+
+type ledgerCommand struct {
+	LedgerFile string
+	ProductID  string
+	Before     *time.Time
+}
+
+var ledgerCommandName = "ledger"
+
+func newLedgerCommand() *cli.Command {
+	command := &ledgerCommand{}
+	ledgerFlag := &cli.StringFlag{Name: "ledger", Usage: "Path to the delivery ledger",
+		EnvVars: envVars("LEDGER"), Destination: &command.LedgerFile, Required: true, DefaultText: defaultTextForRequiredFlags}
+	return &cli.Command{
+		Name:   ledgerCommandName,
+		Usage:  "Inspect and prune the delivery ledger",
+		Before: LogMetadata,
+		Subcommands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the delivered records",
+				Action: command.list,
+				Flags: []cli.Flag{
+					ledgerFlag,
+					&cli.StringFlag{Name: "product-id", Usage: "Only list records of this Odoo Product ID",
+						EnvVars: envVars("PRODUCT_ID"), Destination: &command.ProductID, Required: false, DefaultText: defaultTextForOptionalFlags},
+				},
+			},
+			{
+				Name:   "prune",
+				Usage:  "Remove records with a timerange starting before the given timestamp",
+				Before: command.beforePrune,
+				Action: command.prune,
+				Flags: []cli.Flag{
+					ledgerFlag,
+					&cli.TimestampFlag{Name: "before", Usage: fmt.Sprintf("Records with a timerange starting before this timestamp are removed (%s)", time.RFC3339),
+						EnvVars: envVars("PRUNE_BEFORE"), Layout: time.RFC3339, Required: true, DefaultText: defaultTextForRequiredFlags},
+				},
+			},
+		},
+	}
+}
+
+func (cmd *ledgerCommand) beforePrune(context *cli.Context) error {
+	cmd.Before = context.Timestamp("before")
+	return nil
+}
+
+func (cmd *ledgerCommand) list(context *cli.Context) error {
+	l, err := openExistingLedger(cmd.LedgerFile)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FROM\tTO\tPRODUCT\tSALES ORDER\tINSTANCE\tCONSUMED UNITS\tSINK\tDELIVERED AT")
+	for _, e := range l.Entries() {
+		if cmd.ProductID != "" && e.ProductID != cmd.ProductID {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.From.Format(time.RFC3339),
+			e.To.Format(time.RFC3339),
+			e.ProductID,
+			e.SalesOrderID,
+			e.InstanceID,
+			strconv.FormatFloat(e.ConsumedUnits, 'f', -1, 64),
+			e.Sink,
+			e.DeliveredAt.Format(time.RFC3339),
+		)
+	}
+	return w.Flush()
+}
+
+func (cmd *ledgerCommand) prune(context *cli.Context) error {
+	log := AppLogger(context.Context).WithName(ledgerCommandName)
+
+	l, err := openExistingLedger(cmd.LedgerFile)
+	if err != nil {
+		return err
+	}
+	n, err := l.Prune(*cmd.Before)
+	if err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Pruned %d records", n), "before", cmd.Before.Format(time.RFC3339))
+	return nil
+}
+
+// openExistingLedger opens the ledger and returns an error if it does not exist.
+// Unlike when running reports, a missing ledger most likely is a typo in the path.
+func openExistingLedger(path string) (*ledger.FileLedger, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("could not open ledger: %w", err)
+	}
+	return ledger.Open(path)
+}
@@ -66,6 +66,12 @@ func newApp() (context.Context, context.CancelFunc, *cli.App) {
 		},
 		Commands: []*cli.Command{
 			newReportCommand(),
+			newBatchCommand(),
+			newLedgerCommand(),
+			newValidateCommand(),
+			newPreviewCommand(),
+			newServeCommand(),
+			newGapsCommand(),
 		},
 		ExitErrHandler: func(context *cli.Context, err error) {
 			if err == nil {
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/urfave/cli/v2"
+
+	"github.com/appuio/appuio-reporting/pkg/metrics"
+)
+
+// metricsFlags configures how the metrics of a run are exported.
+type metricsFlags struct {
+	PushURL       string
+	PushJob       string
+	PushGrouping  cli.StringSlice
+	ListenAddress string
+}
+
+func (f *metricsFlags) flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "metrics-push-url", Usage: "URL of a Pushgateway compatible endpoint the metrics are pushed to at the end of the run",
+			EnvVars: envVars("METRICS_PUSH_URL"), Destination: &f.PushURL, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "metrics-push-job", Usage: "Job name the metrics are pushed with",
+			EnvVars: envVars("METRICS_PUSH_JOB"), Destination: &f.PushJob, Value: "appuio_reporting"},
+		&cli.StringSliceFlag{Name: "metrics-push-grouping", Usage: "Label of the grouping key the metrics are pushed with, as label=value. Can be repeated. " +
+			"Pushing replaces the metrics pushed before with the same job and grouping key, so runs of different reports need different grouping keys. " +
+			"Defaults to the product ID given with --product-id or the reports given with --report.",
+			EnvVars: envVars("METRICS_PUSH_GROUPING"), Destination: &f.PushGrouping, DefaultText: "product or report"},
+		&cli.StringFlag{Name: "metrics-listen-address", Usage: "Address to serve the metrics on at /metrics while the command is running (example: :9100)",
+			EnvVars: envVars("METRICS_LISTEN_ADDRESS"), Destination: &f.ListenAddress, DefaultText: defaultTextForOptionalFlags},
+	}
+}
+
+// start creates the metrics and starts serving them if --metrics-listen-address is set.
+// The returned function pushes the metrics if --metrics-push-url is set and stops serving them.
+// The metrics are pushed with the grouping key given with --metrics-push-grouping, or defaultGrouping if the flag is not set.
+// The metrics are nil if they are not exported.
+func (f *metricsFlags) start(log logr.Logger, defaultGrouping map[string]string) (*metrics.Metrics, func(), error) {
+	if f.PushURL == "" && f.ListenAddress == "" {
+		return nil, func() {}, nil
+	}
+
+	grouping := defaultGrouping
+	if values := f.PushGrouping.Value(); len(values) > 0 {
+		grouping = make(map[string]string, len(values))
+		for _, v := range values {
+			label, value, ok := strings.Cut(v, "=")
+			if !ok || label == "" || value == "" {
+				return nil, nil, fmt.Errorf("invalid --metrics-push-grouping %q, expected label=value", v)
+			}
+			grouping[label] = value
+		}
+	}
+
+	m := metrics.New()
+	registry := prometheus.NewRegistry()
+	if err := m.Register(registry); err != nil {
+		return nil, nil, err
+	}
+
+	stopServer := func() {}
+	if f.ListenAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", newMetricsHandler(registry))
+		var err error
+		stopServer, err = listenAndServe(log, f.ListenAddress, mux)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return m, func() {
+		if f.PushURL != "" {
+			pusher := push.New(f.PushURL, f.PushJob).Gatherer(registry)
+			for label, value := range grouping {
+				pusher = pusher.Grouping(label, value)
+			}
+			if err := pusher.Push(); err != nil {
+				log.Error(err, "Could not push metrics", "url", f.PushURL)
+			} else {
+				log.V(1).Info("Pushed metrics", "url", f.PushURL, "job", f.PushJob, "grouping", grouping)
+			}
+		}
+		stopServer()
+	}, nil
+}
+
+// newMetricsHandler serves the metrics of the registry together with the Go runtime and process metrics.
+func newMetricsHandler(registry *prometheus.Registry) http.Handler {
+	runtime := prometheus.NewRegistry()
+	runtime.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return promhttp.HandlerFor(prometheus.Gatherers{registry, runtime}, promhttp.HandlerOpts{})
+}
+
+// listenAndServe serves the handler on addr in the background.
+// The returned function stops the server.
+func listenAndServe(log logr.Logger, addr string, handler http.Handler) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %q: %w", addr, err)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(err, "HTTP server failed")
+		}
+	}()
+	log.Info("Listening", "address", l.Addr().String())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
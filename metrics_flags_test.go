@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsFlags_PushesWithGroupingKey(t *testing.T) {
+	// The order of the labels in the path is not defined, so the pushes are recorded as label sets.
+	var pushes []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/metrics/"), "/")
+		labels := map[string]string{"method": r.Method}
+		for i := 0; i+1 < len(segments); i += 2 {
+			labels[segments[i]] = segments[i+1]
+		}
+		pushes = append(pushes, labels)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	f := &metricsFlags{PushURL: srv.URL, PushJob: "appuio_reporting"}
+	_, stop, err := f.start(logr.Discard(), map[string]string{"product": "storage"})
+	require.NoError(t, err)
+	stop()
+
+	require.NoError(t, f.PushGrouping.Set("cluster=c1"))
+	require.NoError(t, f.PushGrouping.Set("report=storage"))
+	_, stop, err = f.start(logr.Discard(), map[string]string{"product": "storage"})
+	require.NoError(t, err)
+	stop()
+
+	require.Equal(t, []map[string]string{
+		{"method": http.MethodPut, "job": "appuio_reporting", "product": "storage"},
+		{"method": http.MethodPut, "job": "appuio_reporting", "cluster": "c1", "report": "storage"},
+	}, pushes)
+}
+
+func TestMetricsFlags_InvalidGrouping(t *testing.T) {
+	f := &metricsFlags{PushURL: "http://localhost:9091", PushJob: "appuio_reporting"}
+	require.NoError(t, f.PushGrouping.Set("product"))
+	_, _, err := f.start(logr.Discard(), nil)
+	require.ErrorContains(t, err, "expected label=value")
+}
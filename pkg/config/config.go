@@ -0,0 +1,288 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go.uber.org/multierr"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+// Config describes multiple reports sharing the same Prometheus and Odoo connection settings.
+// Since JSON is a subset of YAML, configuration files can be written in either format.
+type Config struct {
+	Prometheus Prometheus `yaml:"prometheus"`
+	Odoo       Odoo       `yaml:"odoo"`
+	// JsonnetLibraryPaths are the directories searched for files imported by the Jsonnet snippets of all reports.
+	// Relative paths are relative to the directory of the configuration file if loaded with Load.
+	JsonnetLibraryPaths []string `yaml:"jsonnetLibraryPaths"`
+	Reports             []Report `yaml:"reports"`
+}
+
+// Prometheus holds the connection settings for Prometheus.
+type Prometheus struct {
+	URL                         string        `yaml:"url"`
+	OrgID                       string        `yaml:"orgId"`
+	QueryTimeout                time.Duration `yaml:"queryTimeout"`
+	ThanosAllowPartialResponses bool          `yaml:"thanosAllowPartialResponses"`
+}
+
+// Odoo holds the connection settings for the Odoo Metered Billing API.
+type Odoo struct {
+	URL               string `yaml:"url"`
+	OauthTokenURL     string `yaml:"oauthTokenUrl"`
+	OauthClientID     string `yaml:"oauthClientId"`
+	OauthClientSecret string `yaml:"oauthClientSecret"`
+	// MaxRecordsPerRequest splits the records into multiple requests if not zero.
+	MaxRecordsPerRequest int `yaml:"maxRecordsPerRequest"`
+	// MaxRequestBodySize splits the records into multiple requests with a body of at most this many bytes if not zero.
+	MaxRequestBodySize int `yaml:"maxRequestBodySize"`
+}
+
+// Report is a named report definition.
+type Report struct {
+	Name                        string        `yaml:"name"`
+	Query                       string        `yaml:"query"`
+	ProductID                   string        `yaml:"productId"`
+	UnitID                      string        `yaml:"unitId"`
+	ProductIDJsonnet            string        `yaml:"productIdJsonnet"`
+	UnitIDJsonnet               string        `yaml:"unitIdJsonnet"`
+	InstanceJsonnet             string        `yaml:"instanceJsonnet"`
+	ItemDescriptionJsonnet      string        `yaml:"itemDescriptionJsonnet"`
+	ItemGroupDescriptionJsonnet string        `yaml:"itemGroupDescriptionJsonnet"`
+	Timerange                   time.Duration `yaml:"timerange"`
+	// SalesOrderLabels are the labels the sales order ID is taken from, tried in order.
+	SalesOrderLabels []string `yaml:"salesOrderLabels"`
+	// SalesOrderJsonnet computes the sales order ID from the labels of a sample. Takes precedence over SalesOrderLabels.
+	SalesOrderJsonnet string `yaml:"salesOrderJsonnet"`
+	// JsonnetExtVars are additional external variables available to the Jsonnet snippets.
+	JsonnetExtVars map[string]string `yaml:"jsonnetExtVars"`
+	// Alignment defines where the timeranges start, see report.Alignment. Defaults to auto.
+	Alignment string `yaml:"alignment"`
+	// Timezone is the timezone of day and month boundaries, for example Europe/Zurich. Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+	// Lag is the time the serve command waits after the end of a timerange before reporting it. Uses the default of the command if zero.
+	Lag time.Duration `yaml:"lag"`
+}
+
+// Load reads and validates the configuration file at the given path.
+func Load(path string) (Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+	c, err := Parse(raw)
+	if err != nil {
+		return Config{}, err
+	}
+	for i, p := range c.JsonnetLibraryPaths {
+		if !filepath.IsAbs(p) {
+			c.JsonnetLibraryPaths[i] = filepath.Join(filepath.Dir(path), p)
+		}
+	}
+	return c, nil
+}
+
+// Parse parses and validates a YAML or JSON configuration.
+// Unknown fields are rejected, so that misspelled fields do not go unnoticed.
+func Parse(raw []byte) (Config, error) {
+	var c Config
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return c, nil
+}
+
+// Validate checks that all reports are named uniquely and contain the required fields.
+func (c Config) Validate() error {
+	var errs error
+	if c.Prometheus.URL == "" {
+		errs = multierr.Append(errs, errors.New("prometheus.url is required"))
+	}
+	names := make(map[string]bool, len(c.Reports))
+	for i, r := range c.Reports {
+		if r.Name == "" {
+			errs = multierr.Append(errs, fmt.Errorf("report %d: name is required", i))
+			continue
+		}
+		if names[r.Name] {
+			errs = multierr.Append(errs, fmt.Errorf("report %q: duplicate name", r.Name))
+		}
+		names[r.Name] = true
+		for _, err := range multierr.Errors(r.validate()) {
+			errs = multierr.Append(errs, fmt.Errorf("report %q: %w", r.Name, err))
+		}
+	}
+	return errs
+}
+
+func (r Report) validate() error {
+	var errs error
+	required := map[string]string{
+		"query":           r.Query,
+		"instanceJsonnet": r.InstanceJsonnet,
+	}
+	for _, field := range []string{"query", "instanceJsonnet"} {
+		if required[field] == "" {
+			errs = multierr.Append(errs, fmt.Errorf("%s is required", field))
+		}
+	}
+	if r.ProductID == "" && r.ProductIDJsonnet == "" {
+		errs = multierr.Append(errs, errors.New("productId is required unless productIdJsonnet is set"))
+	}
+	if r.UnitID == "" && r.UnitIDJsonnet == "" {
+		errs = multierr.Append(errs, errors.New("unitId is required unless unitIdJsonnet is set"))
+	}
+	for _, k := range slices.Sorted(maps.Keys(r.JsonnetExtVars)) {
+		if slices.Contains(report.ReservedExtVars, k) {
+			errs = multierr.Append(errs, fmt.Errorf("jsonnetExtVars: %q is reserved", k))
+		}
+	}
+	if r.Lag < 0 {
+		errs = multierr.Append(errs, errors.New("lag must not be negative"))
+	}
+	if r.Alignment != "" {
+		if _, err := report.ParseAlignment(r.Alignment); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("alignment: %w", err))
+		}
+	}
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("timezone: %w", err))
+	}
+	if err := (report.ReportArgs{TimerangeSize: r.Timerange, Alignment: report.Alignment(r.Alignment)}).CheckTimerange(); err != nil {
+		errs = multierr.Append(errs, err)
+	}
+	return errs
+}
+
+// ValidateOdoo checks that the Odoo connection settings are complete.
+// They are not validated by Validate since they are not required in dry-run mode.
+func (c Config) ValidateOdoo() error {
+	var errs error
+	required := map[string]string{
+		"odoo.url":               c.Odoo.URL,
+		"odoo.oauthTokenUrl":     c.Odoo.OauthTokenURL,
+		"odoo.oauthClientId":     c.Odoo.OauthClientID,
+		"odoo.oauthClientSecret": c.Odoo.OauthClientSecret,
+	}
+	for _, field := range []string{"odoo.url", "odoo.oauthTokenUrl", "odoo.oauthClientId", "odoo.oauthClientSecret"} {
+		if required[field] == "" {
+			errs = multierr.Append(errs, fmt.Errorf("%s is required", field))
+		}
+	}
+	return errs
+}
+
+// LoadOdooEndpoints reads the connection settings of additional Odoo endpoints from a YAML or JSON file containing a list of odoo settings.
+// The endpoints are returned by URL. Settings left empty are meant to be taken from the main Odoo settings.
+func LoadOdooEndpoints(path string) (map[string]Odoo, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Odoo endpoints file: %w", err)
+	}
+	var endpoints []Odoo
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&endpoints); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse Odoo endpoints file: %w", err)
+	}
+	byURL := make(map[string]Odoo, len(endpoints))
+	var errs error
+	for i, e := range endpoints {
+		if e.URL == "" {
+			errs = multierr.Append(errs, fmt.Errorf("endpoint %d: url is required", i))
+			continue
+		}
+		if _, ok := byURL[e.URL]; ok {
+			errs = multierr.Append(errs, fmt.Errorf("endpoint %q: duplicate url", e.URL))
+		}
+		byURL[e.URL] = e
+	}
+	if errs != nil {
+		return nil, fmt.Errorf("invalid Odoo endpoints file: %w", errs)
+	}
+	return byURL, nil
+}
+
+// WithDefaults returns the settings with the empty fields taken from defaults.
+func (o Odoo) WithDefaults(defaults Odoo) Odoo {
+	if o.URL == "" {
+		o.URL = defaults.URL
+	}
+	if o.OauthTokenURL == "" {
+		o.OauthTokenURL = defaults.OauthTokenURL
+	}
+	if o.OauthClientID == "" {
+		o.OauthClientID = defaults.OauthClientID
+	}
+	if o.OauthClientSecret == "" {
+		o.OauthClientSecret = defaults.OauthClientSecret
+	}
+	if o.MaxRecordsPerRequest == 0 {
+		o.MaxRecordsPerRequest = defaults.MaxRecordsPerRequest
+	}
+	if o.MaxRequestBodySize == 0 {
+		o.MaxRequestBodySize = defaults.MaxRequestBodySize
+	}
+	return o
+}
+
+// Select returns the reports with the given names in the given order.
+// All reports are returned if no names are given.
+func (c Config) Select(names ...string) ([]Report, error) {
+	if len(names) == 0 {
+		return c.Reports, nil
+	}
+	byName := make(map[string]Report, len(c.Reports))
+	for _, r := range c.Reports {
+		byName[r.Name] = r
+	}
+	selected := make([]Report, 0, len(names))
+	for _, name := range names {
+		r, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("report %q not found in config", name)
+		}
+		selected = append(selected, r)
+	}
+	return selected, nil
+}
+
+// ReportArgs returns the arguments to run the report with.
+func (r Report) ReportArgs() report.ReportArgs {
+	// The timezone is validated when parsing the configuration. A nil location is UTC.
+	var loc *time.Location
+	if r.Timezone != "" {
+		loc, _ = time.LoadLocation(r.Timezone)
+	}
+	return report.ReportArgs{
+		Query:                       r.Query,
+		InstanceJsonnet:             r.InstanceJsonnet,
+		ItemDescriptionJsonnet:      r.ItemDescriptionJsonnet,
+		ItemGroupDescriptionJsonnet: r.ItemGroupDescriptionJsonnet,
+		UnitID:                      r.UnitID,
+		ProductID:                   r.ProductID,
+		ProductIDJsonnet:            r.ProductIDJsonnet,
+		UnitIDJsonnet:               r.UnitIDJsonnet,
+		TimerangeSize:               r.Timerange,
+		SalesOrderLabels:            r.SalesOrderLabels,
+		SalesOrderJsonnet:           r.SalesOrderJsonnet,
+		JsonnetExtVars:              r.JsonnetExtVars,
+		Alignment:                   report.Alignment(r.Alignment),
+		Location:                    loc,
+	}
+}
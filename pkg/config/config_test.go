@@ -0,0 +1,274 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/config"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+const testConfig = `
+prometheus:
+  url: http://mimir:8080/prometheus
+  orgId: billing
+  queryTimeout: 1m
+odoo:
+  url: https://odoo/api
+  oauthTokenUrl: https://odoo/token
+  oauthClientId: client
+jsonnetLibraryPaths:
+- lib
+- /usr/share/jsonnet
+reports:
+- name: storage
+  query: sum by (sales_order) (storage)
+  productId: storage-product
+  unitId: unit_gb
+  instanceJsonnet: '"storage"'
+  timerange: 1h
+- name: compute
+  query: sum by (sales_order) (compute)
+  productId: compute-product
+  unitId: unit_cpu
+  instanceJsonnet: '"compute"'
+  itemDescriptionJsonnet: '"CPU"'
+  itemGroupDescriptionJsonnet: '"Compute"'
+  timerange: 1h
+  lag: 15m
+  salesOrderLabels:
+  - billing_sales_order
+  - sales_order
+`
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testConfig), 0o644))
+
+	c, err := config.Load(path)
+	require.NoError(t, err)
+
+	require.Equal(t, config.Prometheus{URL: "http://mimir:8080/prometheus", OrgID: "billing", QueryTimeout: time.Minute}, c.Prometheus)
+	require.Equal(t, config.Odoo{URL: "https://odoo/api", OauthTokenURL: "https://odoo/token", OauthClientID: "client"}, c.Odoo)
+	require.Equal(t, []string{filepath.Join(filepath.Dir(path), "lib"), "/usr/share/jsonnet"}, c.JsonnetLibraryPaths, "relative paths should be relative to the config file")
+	require.Len(t, c.Reports, 2)
+	require.Equal(t, report.ReportArgs{
+		Query:                       "sum by (sales_order) (compute)",
+		ProductID:                   "compute-product",
+		UnitID:                      "unit_cpu",
+		InstanceJsonnet:             `"compute"`,
+		ItemDescriptionJsonnet:      `"CPU"`,
+		ItemGroupDescriptionJsonnet: `"Compute"`,
+		TimerangeSize:               time.Hour,
+		SalesOrderLabels:            []string{"billing_sales_order", "sales_order"},
+	}, c.Reports[1].ReportArgs())
+	require.Equal(t, 15*time.Minute, c.Reports[1].Lag)
+}
+
+func TestParse_JSON(t *testing.T) {
+	c, err := config.Parse([]byte(`{"prometheus":{"url":"http://localhost:9090"},"reports":[{"name":"a","query":"q","productId":"p","unitId":"u","instanceJsonnet":"\"i\"","timerange":"1h"}]}`))
+	require.NoError(t, err)
+	require.Equal(t, "a", c.Reports[0].Name)
+	require.Equal(t, time.Hour, c.Reports[0].Timerange)
+}
+
+func TestParse_IDJsonnet(t *testing.T) {
+	c, err := config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: storage
+  query: q
+  productIdJsonnet: 'local labels = std.extVar("labels"); "storage-" + labels.storageclass'
+  unitIdJsonnet: '"unit_gb"'
+  instanceJsonnet: '"i"'
+  timerange: 1h
+`))
+	require.NoError(t, err, "productId and unitId should not be required if computed by Jsonnet")
+	require.Equal(t, `"unit_gb"`, c.Reports[0].ReportArgs().UnitIDJsonnet)
+}
+
+func TestParse_JsonnetExtVars(t *testing.T) {
+	c, err := config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: storage
+  query: q
+  productId: p
+  unitId: u
+  instanceJsonnet: '"i"'
+  timerange: 1h
+  jsonnetExtVars:
+    cluster: c-appuio-cloudscale-lpg-2
+`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"cluster": "c-appuio-cloudscale-lpg-2"}, c.Reports[0].ReportArgs().JsonnetExtVars)
+
+	_, err = config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: storage
+  query: q
+  productId: p
+  unitId: u
+  instanceJsonnet: '"i"'
+  timerange: 1h
+  jsonnetExtVars:
+    labels: x
+`))
+	require.ErrorContains(t, err, `report "storage": jsonnetExtVars: "labels" is reserved`)
+}
+
+func TestParse_Alignment(t *testing.T) {
+	c, err := config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: monthly
+  query: q
+  productId: p
+  unitId: u
+  instanceJsonnet: '"i"'
+  alignment: month
+  timezone: Europe/Zurich
+`))
+	require.NoError(t, err, "timerange should not be required for monthly reports")
+	args := c.Reports[0].ReportArgs()
+	require.Equal(t, report.AlignMonth, args.Alignment)
+	require.Equal(t, "Europe/Zurich", args.Location.String())
+
+	_, err = config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: a
+  query: q
+  productId: p
+  unitId: u
+  instanceJsonnet: '"i"'
+  timerange: 1h
+  alignment: week
+  timezone: Mars/Olympus_Mons
+`))
+	require.ErrorContains(t, err, `report "a": alignment: unknown alignment "week"`)
+	require.ErrorContains(t, err, `report "a": timezone:`)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	_, err := config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: a
+  query: q
+- name: a
+  productId: p
+  timerange: 1h
+  lag: -1m
+- query: q
+`))
+	require.Error(t, err)
+	require.ErrorContains(t, err, `report "a": productId is required`)
+	require.ErrorContains(t, err, `report "a": duplicate name`)
+	require.ErrorContains(t, err, `report "a": timerange should be a positive duration unless the alignment is month`)
+	require.ErrorContains(t, err, `report "a": lag must not be negative`)
+	require.ErrorContains(t, err, `report 2: name is required`)
+}
+
+func TestParse_TimerangeNotMultipleOfAlignment(t *testing.T) {
+	_, err := config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: a
+  query: q
+  productId: p
+  unitId: u
+  instanceJsonnet: '"i"'
+  timerange: 36h
+  alignment: day
+`))
+	require.ErrorContains(t, err, `report "a": timerange should be a multiple of 24h0m0s with alignment day, got: 36h0m0s`)
+}
+
+func TestParse_UnknownField(t *testing.T) {
+	_, err := config.Parse([]byte(`
+prometheus:
+  url: http://localhost:9090
+reports:
+- name: a
+  query: q
+  productId: p
+  unitId: u
+  instanceJsonnet: '"i"'
+  itemDescriptionJsonet: '"d"'
+  timerange: 1h
+`))
+	require.ErrorContains(t, err, "field itemDescriptionJsonet not found")
+}
+
+func TestSelect(t *testing.T) {
+	c, err := config.Parse([]byte(testConfig))
+	require.NoError(t, err)
+
+	all, err := c.Select()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	selected, err := c.Select("compute")
+	require.NoError(t, err)
+	require.Len(t, selected, 1)
+	require.Equal(t, "compute", selected[0].Name)
+
+	_, err = c.Select("network")
+	require.Error(t, err)
+}
+
+func TestValidateOdoo(t *testing.T) {
+	c, err := config.Parse([]byte(testConfig))
+	require.NoError(t, err)
+	require.EqualError(t, c.ValidateOdoo(), "odoo.oauthClientSecret is required")
+
+	c.Odoo.OauthClientSecret = "secret"
+	require.NoError(t, c.ValidateOdoo())
+}
+
+func TestLoadOdooEndpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- url: https://other-odoo/api
+  oauthTokenUrl: https://other-odoo/token
+  oauthClientId: other-client
+  oauthClientSecret: other-secret
+- url: https://odoo/v2/api
+`), 0o600))
+
+	endpoints, err := config.LoadOdooEndpoints(path)
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+
+	defaults := config.Odoo{URL: "https://odoo/api", OauthTokenURL: "https://odoo/token", OauthClientID: "client", OauthClientSecret: "secret", MaxRecordsPerRequest: 100}
+	require.Equal(t, config.Odoo{URL: "https://other-odoo/api", OauthTokenURL: "https://other-odoo/token", OauthClientID: "other-client", OauthClientSecret: "other-secret", MaxRecordsPerRequest: 100},
+		endpoints["https://other-odoo/api"].WithDefaults(defaults))
+	require.Equal(t, config.Odoo{URL: "https://odoo/v2/api", OauthTokenURL: "https://odoo/token", OauthClientID: "client", OauthClientSecret: "secret", MaxRecordsPerRequest: 100},
+		endpoints["https://odoo/v2/api"].WithDefaults(defaults))
+}
+
+func TestLoadOdooEndpoints_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- url: https://other-odoo/api
+- url: https://other-odoo/api
+- oauthClientId: client
+`), 0o600))
+
+	_, err := config.LoadOdooEndpoints(path)
+	require.ErrorContains(t, err, `endpoint "https://other-odoo/api": duplicate url`)
+	require.ErrorContains(t, err, "endpoint 2: url is required")
+}
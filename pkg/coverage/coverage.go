@@ -0,0 +1,159 @@
+// Package coverage compares the records a report produces with the records that have been delivered,
+// to find timeranges that have not been billed or have been billed more than once.
+package coverage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+// Status describes how well the records of a timerange have been delivered.
+type Status string
+
+const (
+	// Complete means all expected records have been delivered exactly once.
+	Complete Status = "complete"
+	// Missing means Prometheus returned data for the timerange, but no records have been delivered.
+	Missing Status = "missing"
+	// Partial means some, but not all expected records have been delivered.
+	Partial Status = "partial"
+	// Duplicated means all expected records have been delivered, but some of them more than once.
+	Duplicated Status = "duplicated"
+)
+
+// Timerange is the result of the comparison for a single timerange of a report.
+type Timerange struct {
+	From time.Time
+	To   time.Time
+
+	// Expected is the number of records the report produces for the timerange.
+	Expected int
+	// Delivered is the number of distinct records that have been delivered for the timerange.
+	Delivered int
+	// Missing is the number of expected records that have not been delivered.
+	Missing int
+	// Duplicated is the number of records that have been delivered more than once.
+	Duplicated int
+}
+
+// Status returns the status of the timerange.
+// A partially delivered timerange is reported as Partial even if some of its records are duplicated.
+func (t Timerange) Status() Status {
+	switch {
+	case t.Missing > 0 && t.Delivered == 0:
+		return Missing
+	case t.Missing > 0:
+		return Partial
+	case t.Duplicated > 0:
+		return Duplicated
+	}
+	return Complete
+}
+
+// Range is a period of consecutive timeranges.
+type Range struct {
+	From time.Time
+	To   time.Time
+}
+
+// key identifies a delivered record the same way the delivery ledger does.
+type key struct {
+	productID    string
+	instanceID   string
+	salesOrderID string
+	from         int64
+	to           int64
+}
+
+func recordKey(r odoo.OdooMeteredBillingRecord) key {
+	return key{
+		productID:    r.ProductID,
+		instanceID:   r.InstanceID,
+		salesOrderID: r.SalesOrderID,
+		from:         r.Timerange.From.UnixNano(),
+		to:           r.Timerange.To.UnixNano(),
+	}
+}
+
+// Check runs the query of the report for each timerange between from and until and compares the resulting records with the delivered records.
+// Only delivered records of the products the report produces are considered. If productID is set, only records of that product are compared.
+// Check fails if the query fails or a sample can not be processed, since the expected records would be incomplete.
+func Check(ctx context.Context, prom report.PromQuerier, args report.ReportArgs, delivered []odoo.OdooMeteredBillingRecord, productID string, from, until time.Time, options ...report.Option) ([]Timerange, error) {
+	if err := args.CheckTimerange(); err != nil {
+		return nil, err
+	}
+	products := make(map[string]bool)
+	if args.ProductIDJsonnet == "" {
+		products[args.ProductID] = true
+	}
+
+	expected := make([][]odoo.OdooMeteredBillingRecord, 0)
+	timeranges := make([]Timerange, 0)
+	for current := from; until.After(current); current = args.TimerangeEnd(current) {
+		records, err := report.Records(ctx, prom, args, current, options...)
+		if err != nil {
+			return nil, fmt.Errorf("could not compute records of timerange starting at %s: %w", current.Format(time.RFC3339), err)
+		}
+		filtered := make([]odoo.OdooMeteredBillingRecord, 0, len(records))
+		for _, r := range records {
+			if productID != "" && r.ProductID != productID {
+				continue
+			}
+			products[r.ProductID] = true
+			filtered = append(filtered, r)
+		}
+		expected = append(expected, filtered)
+		timeranges = append(timeranges, Timerange{From: current.In(time.UTC), To: args.TimerangeEnd(current).In(time.UTC)})
+	}
+	if productID != "" {
+		products = map[string]bool{productID: true}
+	}
+
+	counts := make(map[key]int)
+	for _, r := range delivered {
+		if products[r.ProductID] {
+			counts[recordKey(r)]++
+		}
+	}
+
+	for i := range timeranges {
+		t := &timeranges[i]
+		t.Expected = len(expected[i])
+		for _, r := range expected[i] {
+			if counts[recordKey(r)] == 0 {
+				t.Missing++
+			}
+		}
+		for k, n := range counts {
+			if k.from != t.From.UnixNano() || k.to != t.To.UnixNano() {
+				continue
+			}
+			t.Delivered++
+			if n > 1 {
+				t.Duplicated++
+			}
+		}
+	}
+	return timeranges, nil
+}
+
+// Gaps returns the ranges of consecutive timeranges with missing records.
+// Rerunning the report for these ranges with a delivery ledger delivers the missing records without duplicating the delivered ones.
+func Gaps(timeranges []Timerange) []Range {
+	gaps := make([]Range, 0)
+	for _, t := range timeranges {
+		if s := t.Status(); s != Missing && s != Partial {
+			continue
+		}
+		if n := len(gaps); n > 0 && gaps[n-1].To.Equal(t.From) {
+			gaps[n-1].To = t.To
+			continue
+		}
+		gaps = append(gaps, Range{From: t.From, To: t.To})
+	}
+	return gaps
+}
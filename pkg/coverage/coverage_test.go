@@ -0,0 +1,142 @@
+package coverage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/coverage"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+// timestampQuerier returns the instances registered for the queried timestamp, which is the end of the timerange.
+type timestampQuerier map[time.Time][]string
+
+func (q timestampQuerier) Query(_ context.Context, _ string, ts time.Time, _ ...apiv1.Option) (model.Value, apiv1.Warnings, error) {
+	v := model.Vector{}
+	for _, instance := range q[ts] {
+		v = append(v, &model.Sample{
+			Metric: model.Metric{"sales_order": "SO1", "instance": model.LabelValue(instance)},
+			Value:  1,
+		})
+	}
+	return v, nil, nil
+}
+
+var begin = time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+func hour(n int) time.Time {
+	return begin.Add(time.Duration(n) * time.Hour)
+}
+
+func reportArgs() report.ReportArgs {
+	return report.ReportArgs{
+		ProductID:       "product",
+		UnitID:          "unit",
+		Query:           "up",
+		InstanceJsonnet: `std.extVar("labels").instance`,
+		TimerangeSize:   time.Hour,
+	}
+}
+
+func delivered(productID, instance string, from int) odoo.OdooMeteredBillingRecord {
+	return odoo.OdooMeteredBillingRecord{
+		ProductID:    productID,
+		InstanceID:   instance,
+		SalesOrderID: "SO1",
+		Timerange:    odoo.Timerange{From: hour(from), To: hour(from + 1)},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	prom := timestampQuerier{
+		hour(1): {"a", "b"},
+		hour(2): {"a", "b"},
+		hour(3): {"a"},
+		hour(4): {"a"},
+		hour(5): {"a"},
+	}
+	records := []odoo.OdooMeteredBillingRecord{
+		delivered("product", "a", 0),
+		delivered("product", "b", 0),
+		delivered("product", "a", 1),
+		delivered("product", "a", 3),
+		delivered("product", "a", 3),
+		// Records of other products are ignored.
+		delivered("other", "a", 2),
+	}
+
+	timeranges, err := coverage.Check(context.Background(), prom, reportArgs(), records, "", hour(0), hour(5))
+	require.NoError(t, err)
+	require.Equal(t, []coverage.Timerange{
+		{From: hour(0), To: hour(1), Expected: 2, Delivered: 2},
+		{From: hour(1), To: hour(2), Expected: 2, Delivered: 1, Missing: 1},
+		{From: hour(2), To: hour(3), Expected: 1, Missing: 1},
+		{From: hour(3), To: hour(4), Expected: 1, Delivered: 1, Duplicated: 1},
+		{From: hour(4), To: hour(5), Expected: 1, Missing: 1},
+	}, timeranges)
+
+	statuses := make([]coverage.Status, len(timeranges))
+	for i, tr := range timeranges {
+		statuses[i] = tr.Status()
+	}
+	require.Equal(t, []coverage.Status{coverage.Complete, coverage.Partial, coverage.Missing, coverage.Duplicated, coverage.Missing}, statuses)
+
+	require.Equal(t, []coverage.Range{
+		{From: hour(1), To: hour(3)},
+		{From: hour(4), To: hour(5)},
+	}, coverage.Gaps(timeranges))
+}
+
+func TestCheck_ProductIDJsonnet(t *testing.T) {
+	prom := timestampQuerier{
+		hour(1): {"a", "b"},
+	}
+	args := reportArgs()
+	args.ProductIDJsonnet = `"product-" + std.extVar("labels").instance`
+	records := []odoo.OdooMeteredBillingRecord{
+		delivered("product-a", "a", 0),
+		delivered("product-a", "a", 0),
+		delivered("other", "b", 0),
+	}
+
+	timeranges, err := coverage.Check(context.Background(), prom, args, records, "", hour(0), hour(1))
+	require.NoError(t, err)
+	require.Equal(t, []coverage.Timerange{
+		{From: hour(0), To: hour(1), Expected: 2, Delivered: 1, Missing: 1, Duplicated: 1},
+	}, timeranges)
+
+	timeranges, err = coverage.Check(context.Background(), prom, args, records, "product-a", hour(0), hour(1))
+	require.NoError(t, err)
+	require.Equal(t, []coverage.Timerange{
+		{From: hour(0), To: hour(1), Expected: 1, Delivered: 1, Duplicated: 1},
+	}, timeranges)
+}
+
+func TestCheck_FailsOnSampleErrors(t *testing.T) {
+	args := reportArgs()
+	args.InstanceJsonnet = `std.extVar("labels").missing`
+
+	_, err := coverage.Check(context.Background(), timestampQuerier{hour(1): {"a"}}, args, nil, "", hour(0), hour(1))
+	require.ErrorContains(t, err, "timerange starting at 2024-03-01T00:00:00Z")
+}
+
+func TestCheck_RejectsTimerangeNotMultipleOfAlignment(t *testing.T) {
+	args := reportArgs()
+	args.Alignment = report.AlignDay
+
+	_, err := coverage.Check(context.Background(), timestampQuerier{}, args, nil, "", hour(0), hour(48))
+	require.ErrorContains(t, err, "timerange should be a multiple of 24h0m0s with alignment day")
+}
+
+func TestGaps_Empty(t *testing.T) {
+	require.Empty(t, coverage.Gaps([]coverage.Timerange{
+		{From: hour(0), To: hour(1), Expected: 1, Delivered: 1},
+		{From: hour(1), To: hour(2)},
+	}))
+}
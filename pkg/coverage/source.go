@@ -0,0 +1,154 @@
+package coverage
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+// ErrNotSupported is returned by sources that can not list delivered records yet.
+var ErrNotSupported = errors.New("not supported")
+
+// Source lists the records that have been delivered.
+type Source interface {
+	Delivered(ctx context.Context) ([]odoo.OdooMeteredBillingRecord, error)
+}
+
+// LedgerSource lists the records of a delivery ledger.
+type LedgerSource struct {
+	Ledger *ledger.FileLedger
+	// Sink is the sink whose deliveries are listed. Defaults to ledger.DefaultSink.
+	Sink string
+}
+
+// Delivered returns the records the ledger recorded for the sink.
+// The ledger only stores each record once per sink, so records delivered from the ledger are never duplicated.
+func (s LedgerSource) Delivered(_ context.Context) ([]odoo.OdooMeteredBillingRecord, error) {
+	sink := s.Sink
+	if sink == "" {
+		sink = ledger.DefaultSink
+	}
+	entries := s.Ledger.Entries()
+	records := make([]odoo.OdooMeteredBillingRecord, 0, len(entries))
+	for _, e := range entries {
+		if e.Sink != sink {
+			continue
+		}
+		records = append(records, odoo.OdooMeteredBillingRecord{
+			ProductID:     e.ProductID,
+			InstanceID:    e.InstanceID,
+			SalesOrderID:  e.SalesOrderID,
+			ConsumedUnits: e.ConsumedUnits,
+			Timerange:     odoo.Timerange{From: e.From, To: e.To},
+		})
+	}
+	return records, nil
+}
+
+// FileSource lists the records of a file written by a file sink.
+type FileSource struct {
+	Path string
+	// Read parses the file, see ReadJSONL and ReadCSV.
+	Read func(io.Reader) ([]odoo.OdooMeteredBillingRecord, error)
+}
+
+// Delivered returns the records in the file.
+func (s FileSource) Delivered(_ context.Context) ([]odoo.OdooMeteredBillingRecord, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := s.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", s.Path, err)
+	}
+	return records, nil
+}
+
+// ReadJSONL parses records written by a JSON Lines sink.
+func ReadJSONL(r io.Reader) ([]odoo.OdooMeteredBillingRecord, error) {
+	records := make([]odoo.OdooMeteredBillingRecord, 0)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var record odoo.OdooMeteredBillingRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// csvColumns are the columns ReadCSV requires to identify a record.
+var csvColumns = []string{"product_id", "instance_id", "sales_order_id", "timerange_from", "timerange_to"}
+
+// ReadCSV parses records written by a CSV sink.
+// The file must have been written with a header containing at least the product_id, instance_id, sales_order_id, timerange_from and timerange_to columns.
+func ReadCSV(r io.Reader) ([]odoo.OdooMeteredBillingRecord, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return []odoo.OdooMeteredBillingRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, len(header))
+	for i, c := range header {
+		index[c] = i
+	}
+	for _, c := range csvColumns {
+		if _, ok := index[c]; !ok {
+			return nil, fmt.Errorf("missing column %q, the file must be written with a header and contain the columns %v", c, csvColumns)
+		}
+	}
+
+	records := make([]odoo.OdooMeteredBillingRecord, 0)
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		from, err := time.Parse(time.RFC3339, row[index["timerange_from"]])
+		if err != nil {
+			return nil, fmt.Errorf("row %d: invalid timerange_from: %w", len(records)+2, err)
+		}
+		to, err := time.Parse(time.RFC3339, row[index["timerange_to"]])
+		if err != nil {
+			return nil, fmt.Errorf("row %d: invalid timerange_to: %w", len(records)+2, err)
+		}
+		records = append(records, odoo.OdooMeteredBillingRecord{
+			ProductID:    row[index["product_id"]],
+			InstanceID:   row[index["instance_id"]],
+			SalesOrderID: row[index["sales_order_id"]],
+			Timerange:    odoo.Timerange{From: from, To: to},
+		})
+	}
+}
+
+// OdooSource lists the records delivered to the Odoo Metered Billing API.
+// The API does not provide an endpoint to read delivered records yet, so Delivered always returns ErrNotSupported.
+type OdooSource struct {
+	URL string
+}
+
+// Delivered returns ErrNotSupported.
+func (s OdooSource) Delivered(_ context.Context) ([]odoo.OdooMeteredBillingRecord, error) {
+	return nil, fmt.Errorf("reading delivered records from the Odoo Metered Billing API: %w", ErrNotSupported)
+}
@@ -0,0 +1,84 @@
+package coverage_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/coverage"
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/sink"
+)
+
+func sinkRecords() []odoo.OdooMeteredBillingRecord {
+	r := delivered("product", "a", 0)
+	r.UnitID = "unit"
+	r.ConsumedUnits = 1.5
+	return []odoo.OdooMeteredBillingRecord{r, delivered("product", "b", 1)}
+}
+
+func TestReadJSONL(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, sink.NewJSONLSink(buf).SendData(context.Background(), sinkRecords()))
+
+	records, err := coverage.ReadJSONL(buf)
+	require.NoError(t, err)
+	require.Equal(t, sinkRecords(), records)
+
+	_, err = coverage.ReadJSONL(strings.NewReader(`{"product_id":"p","timerange":"yesterday"}`))
+	require.ErrorContains(t, err, "record 1")
+}
+
+func TestReadCSV(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s, err := sink.NewCSVSink(buf, nil, true)
+	require.NoError(t, err)
+	require.NoError(t, s.SendData(context.Background(), sinkRecords()))
+
+	records, err := coverage.ReadCSV(buf)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	for i, r := range sinkRecords() {
+		require.Equal(t, r.ProductID, records[i].ProductID)
+		require.Equal(t, r.InstanceID, records[i].InstanceID)
+		require.Equal(t, r.SalesOrderID, records[i].SalesOrderID)
+		require.Equal(t, r.Timerange, records[i].Timerange)
+	}
+}
+
+func TestReadCSV_RequiresHeader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s, err := sink.NewCSVSink(buf, nil, false)
+	require.NoError(t, err)
+	require.NoError(t, s.SendData(context.Background(), sinkRecords()))
+
+	_, err = coverage.ReadCSV(buf)
+	require.ErrorContains(t, err, `missing column "product_id"`)
+}
+
+func TestLedgerSource(t *testing.T) {
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.json"))
+	require.NoError(t, err)
+	require.NoError(t, l.ForSink(ledger.DefaultSink).Record(sinkRecords()))
+	require.NoError(t, l.ForSink("jsonl=out.jsonl").Record(sinkRecords()[:1]))
+
+	records, err := coverage.LedgerSource{Ledger: l}.Delivered(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "a", records[0].InstanceID)
+	require.Equal(t, sinkRecords()[0].Timerange, records[0].Timerange)
+
+	records, err = coverage.LedgerSource{Ledger: l, Sink: "jsonl=out.jsonl"}.Delivered(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func TestOdooSource_NotSupported(t *testing.T) {
+	_, err := coverage.OdooSource{URL: "https://odoo.example.com"}.Delivered(context.Background())
+	require.ErrorIs(t, err, coverage.ErrNotSupported)
+}
@@ -0,0 +1,242 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/appuio/appuio-reporting/pkg/atomicfile"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+// DefaultSink is the sink of entries written before entries were kept per sink.
+// Records were only delivered to Odoo at that time.
+const DefaultSink = "odoo"
+
+// Entry is a record that has been delivered successfully to a sink.
+type Entry struct {
+	Sink          string    `json:"sink"`
+	ProductID     string    `json:"productId"`
+	InstanceID    string    `json:"instanceId"`
+	SalesOrderID  string    `json:"salesOrderId"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	ConsumedUnits float64   `json:"consumedUnits"`
+	DeliveredAt   time.Time `json:"deliveredAt"`
+}
+
+type key struct {
+	sink         string
+	productID    string
+	instanceID   string
+	salesOrderID string
+	from         int64
+	to           int64
+}
+
+func keyFor(sink, productID, instanceID, salesOrderID string, from, to time.Time) key {
+	return key{
+		sink:         sink,
+		productID:    productID,
+		instanceID:   instanceID,
+		salesOrderID: salesOrderID,
+		from:         from.UnixNano(),
+		to:           to.UnixNano(),
+	}
+}
+
+func (e Entry) key() key {
+	return keyFor(e.Sink, e.ProductID, e.InstanceID, e.SalesOrderID, e.From, e.To)
+}
+
+func recordKey(sink string, r odoo.OdooMeteredBillingRecord) key {
+	return keyFor(sink, r.ProductID, r.InstanceID, r.SalesOrderID, r.Timerange.From, r.Timerange.To)
+}
+
+type file struct {
+	Entries []Entry `json:"entries"`
+}
+
+// FileLedger is a delivery ledger persisted as a JSON file.
+// Records are identified by the sink they were delivered to, their product ID, instance ID, sales order ID and timerange.
+// FileLedger is safe for concurrent use.
+type FileLedger struct {
+	path      string
+	now       func() time.Time
+	retention time.Duration
+
+	mu      sync.Mutex
+	entries map[key]Entry
+}
+
+// Option configures a FileLedger.
+type Option interface {
+	set(*FileLedger)
+}
+
+// WithRetention prunes entries with a timerange starting more than the given duration ago whenever the ledger is written,
+// so that the ledger does not grow without bounds. Zero keeps all entries.
+func WithRetention(d time.Duration) Option {
+	return retention(d)
+}
+
+type retention time.Duration
+
+func (r retention) set(l *FileLedger) {
+	l.retention = time.Duration(r)
+}
+
+// Open loads the ledger from the given path.
+// An empty ledger is returned if the file does not exist yet. The file is created on the first write.
+func Open(path string, opts ...Option) (*FileLedger, error) {
+	l := &FileLedger{
+		path:    path,
+		now:     time.Now,
+		entries: make(map[key]Entry),
+	}
+	for _, o := range opts {
+		o.set(l)
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger: %w", err)
+	}
+	var f file
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse ledger %q: %w", path, err)
+	}
+	for _, e := range f.Entries {
+		if e.Sink == "" {
+			e.Sink = DefaultSink
+		}
+		l.entries[e.key()] = e
+	}
+	return l, nil
+}
+
+// RetainedSince returns the beginning of the retention period.
+// Entries with a timerange starting before are pruned. Returns the zero time if all entries are kept.
+func (l *FileLedger) RetainedSince() time.Time {
+	if l.retention <= 0 {
+		return time.Time{}
+	}
+	return l.now().Add(-l.retention)
+}
+
+// ForSink returns a view of the ledger keeping track of the records delivered to the given sink.
+func (l *FileLedger) ForSink(sink string) SinkLedger {
+	return SinkLedger{ledger: l, sink: sink}
+}
+
+// SinkLedger keeps track of the records delivered to a single sink. See FileLedger.ForSink.
+type SinkLedger struct {
+	ledger *FileLedger
+	sink   string
+}
+
+// Delivered returns true if the record has been delivered to the sink before.
+func (s SinkLedger) Delivered(r odoo.OdooMeteredBillingRecord) bool {
+	s.ledger.mu.Lock()
+	defer s.ledger.mu.Unlock()
+	_, ok := s.ledger.entries[recordKey(s.sink, r)]
+	return ok
+}
+
+// Record marks the records as delivered to the sink and persists the ledger.
+func (s SinkLedger) Record(records []odoo.OdooMeteredBillingRecord) error {
+	l := s.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now().UTC()
+	for _, r := range records {
+		l.entries[recordKey(s.sink, r)] = Entry{
+			Sink:          s.sink,
+			ProductID:     r.ProductID,
+			InstanceID:    r.InstanceID,
+			SalesOrderID:  r.SalesOrderID,
+			From:          r.Timerange.From.UTC(),
+			To:            r.Timerange.To.UTC(),
+			ConsumedUnits: r.ConsumedUnits,
+			DeliveredAt:   now,
+		}
+	}
+	if since := l.RetainedSince(); !since.IsZero() {
+		l.prune(since)
+	}
+	return l.save()
+}
+
+// Entries returns all entries ordered by timerange, product, sales order and instance.
+func (l *FileLedger) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sortedEntries()
+}
+
+// Prune removes all entries with a timerange starting before the given time and persists the ledger.
+// Returns the number of removed entries.
+func (l *FileLedger) Prune(before time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.prune(before)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, l.save()
+}
+
+func (l *FileLedger) prune(before time.Time) int {
+	n := 0
+	for k, e := range l.entries {
+		if e.From.Before(before) {
+			delete(l.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+func (l *FileLedger) sortedEntries() []Entry {
+	entries := make([]Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.From.Equal(b.From) {
+			return a.From.Before(b.From)
+		}
+		if !a.To.Equal(b.To) {
+			return a.To.Before(b.To)
+		}
+		if a.ProductID != b.ProductID {
+			return a.ProductID < b.ProductID
+		}
+		if a.SalesOrderID != b.SalesOrderID {
+			return a.SalesOrderID < b.SalesOrderID
+		}
+		if a.InstanceID != b.InstanceID {
+			return a.InstanceID < b.InstanceID
+		}
+		return a.Sink < b.Sink
+	})
+	return entries
+}
+
+func (l *FileLedger) save() error {
+	raw, err := json.MarshalIndent(file{Entries: l.sortedEntries()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(l.path, raw); err != nil {
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	return nil
+}
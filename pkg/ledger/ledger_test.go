@@ -0,0 +1,125 @@
+package ledger_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+func TestFileLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+
+	l, err := ledger.Open(path)
+	require.NoError(t, err)
+	require.Empty(t, l.Entries())
+
+	base := time.Date(2023, time.July, 1, 0, 0, 0, 0, time.UTC)
+	first := getRecord("instance-a", base)
+	second := getRecord("instance-b", base)
+	later := getRecord("instance-a", base.Add(time.Hour))
+
+	s := l.ForSink("odoo")
+	require.False(t, s.Delivered(first))
+	require.NoError(t, s.Record([]odoo.OdooMeteredBillingRecord{first, second, later}))
+	require.True(t, s.Delivered(first))
+
+	other := first
+	other.SalesOrderID = "SO00001"
+	require.False(t, s.Delivered(other), "records with a different sales order should not be considered delivered")
+
+	reopened, err := ledger.Open(path)
+	require.NoError(t, err)
+	rs := reopened.ForSink("odoo")
+	require.True(t, rs.Delivered(first))
+	require.True(t, rs.Delivered(second))
+	require.True(t, rs.Delivered(later))
+	require.Len(t, reopened.Entries(), 3)
+	require.Equal(t, "instance-a", reopened.Entries()[0].InstanceID)
+	require.Equal(t, base.Add(time.Hour), reopened.Entries()[2].From)
+
+	n, err := reopened.Prune(base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.False(t, rs.Delivered(first))
+	require.True(t, rs.Delivered(later))
+
+	pruned, err := ledger.Open(path)
+	require.NoError(t, err)
+	require.Len(t, pruned.Entries(), 1)
+}
+
+func TestFileLedger_MatchesTimezones(t *testing.T) {
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.json"))
+	require.NoError(t, err)
+
+	from := time.Date(2023, time.July, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, l.ForSink("odoo").Record([]odoo.OdooMeteredBillingRecord{getRecord("instance", from)}))
+
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	require.NoError(t, err)
+	require.True(t, l.ForSink("odoo").Delivered(getRecord("instance", from.In(zurich))))
+}
+
+func TestFileLedger_KeepsTrackPerSink(t *testing.T) {
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.json"))
+	require.NoError(t, err)
+
+	r := getRecord("instance", time.Date(2023, time.July, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, l.ForSink("csv=records.csv").Record([]odoo.OdooMeteredBillingRecord{r}))
+	require.True(t, l.ForSink("csv=records.csv").Delivered(r))
+	require.False(t, l.ForSink("odoo").Delivered(r), "records delivered to another sink should not be considered delivered")
+
+	require.NoError(t, l.ForSink("odoo").Record([]odoo.OdooMeteredBillingRecord{r}))
+	require.Len(t, l.Entries(), 2)
+	require.Equal(t, "csv=records.csv", l.Entries()[0].Sink)
+	require.Equal(t, "odoo", l.Entries()[1].Sink)
+}
+
+func TestFileLedger_EntriesWithoutSinkWereDeliveredToOdoo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"entries":[{"productId":"my-product","instanceId":"instance","salesOrderId":"SO00000","from":"2023-07-01T00:00:00Z","to":"2023-07-01T01:00:00Z"}]}`), 0o644))
+
+	l, err := ledger.Open(path)
+	require.NoError(t, err)
+	r := getRecord("instance", time.Date(2023, time.July, 1, 0, 0, 0, 0, time.UTC))
+	require.True(t, l.ForSink(ledger.DefaultSink).Delivered(r))
+	require.False(t, l.ForSink("jsonl=records.jsonl").Delivered(r))
+}
+
+func TestFileLedger_PrunesEntriesOutsideRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	l, err := ledger.Open(path, ledger.WithRetention(24*time.Hour))
+	require.NoError(t, err)
+
+	recent := getRecord("instance", time.Now().Add(-time.Hour).Truncate(time.Hour))
+	old := getRecord("instance", time.Now().Add(-48*time.Hour).Truncate(time.Hour))
+	require.NoError(t, l.ForSink("odoo").Record([]odoo.OdooMeteredBillingRecord{recent, old}))
+	require.True(t, l.ForSink("odoo").Delivered(recent))
+	require.False(t, l.ForSink("odoo").Delivered(old))
+	require.WithinDuration(t, time.Now().Add(-24*time.Hour), l.RetainedSince(), time.Minute)
+
+	reopened, err := ledger.Open(path)
+	require.NoError(t, err)
+	require.Len(t, reopened.Entries(), 1)
+	require.True(t, reopened.RetainedSince().IsZero())
+}
+
+func getRecord(instance string, from time.Time) odoo.OdooMeteredBillingRecord {
+	return odoo.OdooMeteredBillingRecord{
+		ProductID:     "my-product",
+		InstanceID:    instance,
+		SalesOrderID:  "SO00000",
+		UnitID:        "my-unit",
+		ConsumedUnits: 1,
+		Timerange: odoo.Timerange{
+			From: from,
+			To:   from.Add(time.Hour),
+		},
+	}
+}
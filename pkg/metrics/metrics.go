@@ -0,0 +1,133 @@
+// Package metrics provides Prometheus metrics of report runs.
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "appuio_reporting"
+
+// Metrics are the Prometheus metrics of report runs.
+// All methods are safe to call on a nil *Metrics, in which case they do nothing.
+type Metrics struct {
+	queryDuration  *prometheus.HistogramVec
+	samples        *prometheus.CounterVec
+	sampleFailures *prometheus.CounterVec
+	recordsSent    *prometheus.CounterVec
+	lastSuccess    *prometheus.GaugeVec
+	odooRequests   *prometheus.CounterVec
+
+	mu               sync.Mutex
+	lastSuccessTimes map[string]time.Time
+}
+
+// New creates the metrics. They need to be registered with Register to be exported.
+func New() *Metrics {
+	return &Metrics{
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "query_duration_seconds",
+			Help:      "Duration of the Prometheus queries of a report, including retries.",
+			Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300},
+		}, []string{"product"}),
+		samples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "samples_total",
+			Help:      "Number of samples returned by the Prometheus queries of a report.",
+		}, []string{"product"}),
+		sampleFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sample_failures_total",
+			Help:      "Number of samples that could not be processed into records.",
+		}, []string{"product"}),
+		recordsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "records_sent_total",
+			Help:      "Number of records that were sent successfully.",
+		}, []string{"product"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_successful_report_timestamp_seconds",
+			Help:      "Beginning of the last timerange that was reported successfully, as Unix timestamp.",
+		}, []string{"product"}),
+		odooRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "odoo_requests_total",
+			Help:      `Number of requests sent to the Odoo API by status code. The code is "error" if no response was received.`,
+		}, []string{"code"}),
+		lastSuccessTimes: make(map[string]time.Time),
+	}
+}
+
+// Register registers the metrics with the registerer.
+func (m *Metrics) Register(r prometheus.Registerer) error {
+	for _, c := range m.collectors() {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.queryDuration, m.samples, m.sampleFailures, m.recordsSent, m.lastSuccess, m.odooRequests}
+}
+
+// ObserveQuery records the duration of a query and the number of samples it returned.
+// The product is empty if the product ID is computed per sample.
+func (m *Metrics) ObserveQuery(product string, duration time.Duration, samples int) {
+	if m == nil {
+		return
+	}
+	m.queryDuration.WithLabelValues(product).Observe(duration.Seconds())
+	m.samples.WithLabelValues(product).Add(float64(samples))
+}
+
+// AddSampleFailures records samples that could not be processed into records.
+// The product is empty if the product ID is computed per sample and could not be computed for the failed samples.
+func (m *Metrics) AddSampleFailures(product string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.sampleFailures.WithLabelValues(product).Add(float64(n))
+}
+
+// AddRecordsSent records records that were sent successfully.
+func (m *Metrics) AddRecordsSent(product string, n int) {
+	if m == nil {
+		return
+	}
+	m.recordsSent.WithLabelValues(product).Add(float64(n))
+}
+
+// SetLastSuccess records the beginning of a timerange that was reported successfully.
+// The timestamp is only updated if it is later than the previous one, since the reports of a range can complete out of order.
+func (m *Metrics) SetLastSuccess(product string, from time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.lastSuccessTimes[product]; ok && !from.After(last) {
+		return
+	}
+	m.lastSuccessTimes[product] = from
+	m.lastSuccess.WithLabelValues(product).Set(float64(from.Unix()))
+}
+
+// ObserveOdooRequest records a request to the Odoo API.
+// The status code is 0 if no response was received.
+func (m *Metrics) ObserveOdooRequest(statusCode int) {
+	if m == nil {
+		return
+	}
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	m.odooRequests.WithLabelValues(code).Inc()
+}
@@ -0,0 +1,59 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	m := metrics.New()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, m.Register(registry))
+
+	m.ObserveQuery("p", time.Second, 3)
+	m.AddSampleFailures("p", 1)
+	m.AddRecordsSent("p", 2)
+	m.SetLastSuccess("p", time.Unix(7200, 0))
+	m.SetLastSuccess("p", time.Unix(3600, 0))
+	m.ObserveOdooRequest(200)
+	m.ObserveOdooRequest(0)
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP appuio_reporting_last_successful_report_timestamp_seconds Beginning of the last timerange that was reported successfully, as Unix timestamp.
+# TYPE appuio_reporting_last_successful_report_timestamp_seconds gauge
+appuio_reporting_last_successful_report_timestamp_seconds{product="p"} 7200
+# HELP appuio_reporting_odoo_requests_total Number of requests sent to the Odoo API by status code. The code is "error" if no response was received.
+# TYPE appuio_reporting_odoo_requests_total counter
+appuio_reporting_odoo_requests_total{code="200"} 1
+appuio_reporting_odoo_requests_total{code="error"} 1
+# HELP appuio_reporting_records_sent_total Number of records that were sent successfully.
+# TYPE appuio_reporting_records_sent_total counter
+appuio_reporting_records_sent_total{product="p"} 2
+# HELP appuio_reporting_sample_failures_total Number of samples that could not be processed into records.
+# TYPE appuio_reporting_sample_failures_total counter
+appuio_reporting_sample_failures_total{product="p"} 1
+# HELP appuio_reporting_samples_total Number of samples returned by the Prometheus queries of a report.
+# TYPE appuio_reporting_samples_total counter
+appuio_reporting_samples_total{product="p"} 3
+`), "appuio_reporting_last_successful_report_timestamp_seconds", "appuio_reporting_odoo_requests_total",
+		"appuio_reporting_records_sent_total", "appuio_reporting_sample_failures_total", "appuio_reporting_samples_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(registry, "appuio_reporting_query_duration_seconds"))
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *metrics.Metrics
+	require.NotPanics(t, func() {
+		m.ObserveQuery("p", time.Second, 1)
+		m.AddSampleFailures("p", 1)
+		m.AddRecordsSent("p", 1)
+		m.SetLastSuccess("p", time.Now())
+		m.ObserveOdooRequest(500)
+	})
+}
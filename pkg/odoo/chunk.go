@@ -0,0 +1,87 @@
+package odoo
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// requestBodyOverhead is the size of the request body without any records: `{"data":[]}`.
+const requestBodyOverhead = len(`{"data":[]}`)
+
+// chunk is a part of the records sent in a single request.
+type chunk struct {
+	// offset is the index of the first record of the chunk.
+	offset  int
+	records []OdooMeteredBillingRecord
+	body    []byte
+}
+
+// ChunkError is returned if sending a chunk of the records failed.
+// All records before Offset have been delivered successfully.
+type ChunkError struct {
+	// Chunk is the number of the failed chunk, starting at 1.
+	Chunk  int
+	Chunks int
+	// Offset is the index of the first record of the failed chunk.
+	Offset int
+	// Count is the number of records in the failed chunk.
+	Count int
+	Err   error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("failed to send chunk %d of %d (records %d to %d): %s", e.Chunk, e.Chunks, e.Offset+1, e.Offset+e.Count, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// splitRecords splits the records into chunks with at most maxRecords records and a request body of at most maxBodySize bytes.
+// A limit of zero disables the respective check. A single chunk is returned for empty records.
+func splitRecords(data []OdooMeteredBillingRecord, maxRecords, maxBodySize int) ([]chunk, error) {
+	if maxRecords <= 0 && maxBodySize <= 0 {
+		body, err := marshalRequestBody(data)
+		if err != nil {
+			return nil, err
+		}
+		return []chunk{{offset: 0, records: data, body: body}}, nil
+	}
+
+	chunks := make([]chunk, 0, 1)
+	start, size := 0, requestBodyOverhead
+	flush := func(end int) error {
+		body, err := marshalRequestBody(data[start:end])
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk{offset: start, records: data[start:end], body: body})
+		start, size = end, requestBodyOverhead
+		return nil
+	}
+	for i, r := range data {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		recordSize := len(raw)
+		if i > start {
+			// Separating comma
+			recordSize++
+		}
+		if maxBodySize > 0 && requestBodyOverhead+len(raw) > maxBodySize {
+			return nil, fmt.Errorf("record %d (instance %q) exceeds the maximum request body size of %d bytes", i+1, r.InstanceID, maxBodySize)
+		}
+		if i > start && ((maxRecords > 0 && i-start >= maxRecords) || (maxBodySize > 0 && size+recordSize > maxBodySize)) {
+			if err := flush(i); err != nil {
+				return nil, err
+			}
+			recordSize = len(raw)
+		}
+		size += recordSize
+	}
+	if err := flush(len(data)); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
@@ -0,0 +1,103 @@
+package odoo_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+func TestSendDataSplitsByRecordCount(t *testing.T) {
+	srv, bodies := newRecordingServer(t, -1)
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithMaxRecordsPerRequest(2))
+
+	require.NoError(t, uut.SendData(context.Background(), getOdooRecords(5)))
+	require.Equal(t, []int{2, 2, 1}, recordsPerBody(t, *bodies))
+}
+
+func TestSendDataSplitsByBodySize(t *testing.T) {
+	srv, bodies := newRecordingServer(t, -1)
+
+	single, err := json.Marshal(map[string]any{"data": getOdooRecords(1)})
+	require.NoError(t, err)
+	// Allows two records per request, but not three.
+	maxSize := 2*len(single) - len(`{"data":[]}`) + 1
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithMaxRequestBodySize(maxSize))
+
+	require.NoError(t, uut.SendData(context.Background(), getOdooRecords(5)))
+	require.Equal(t, []int{2, 2, 1}, recordsPerBody(t, *bodies))
+	for _, b := range *bodies {
+		require.LessOrEqual(t, len(b), maxSize)
+	}
+}
+
+func TestSendDataFailsForRecordsLargerThanBodySize(t *testing.T) {
+	srv, bodies := newRecordingServer(t, -1)
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithMaxRequestBodySize(100))
+
+	require.ErrorContains(t, uut.SendData(context.Background(), getOdooRecords(2)), "exceeds the maximum request body size")
+	require.Empty(t, *bodies)
+}
+
+func TestSendDataReportsFailedChunk(t *testing.T) {
+	srv, bodies := newRecordingServer(t, 2)
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithMaxRecordsPerRequest(2))
+
+	err := uut.SendData(context.Background(), getOdooRecords(5))
+	var chunkErr *odoo.ChunkError
+	require.True(t, errors.As(err, &chunkErr))
+	require.Equal(t, 2, chunkErr.Chunk)
+	require.Equal(t, 3, chunkErr.Chunks)
+	require.Equal(t, 2, chunkErr.Offset)
+	require.Equal(t, 2, chunkErr.Count)
+	require.ErrorContains(t, err, "failed to send chunk 2 of 3 (records 3 to 4)")
+	require.Len(t, *bodies, 2, "remaining chunks should not be sent")
+}
+
+// newRecordingServer returns a server recording all request bodies. The request with the number failAt fails with a 400 response.
+func newRecordingServer(t *testing.T, failAt int) (*httptest.Server, *[]string) {
+	bodies := make([]string, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == failAt {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &bodies
+}
+
+func recordsPerBody(t *testing.T, bodies []string) []int {
+	counts := make([]int, 0, len(bodies))
+	for _, b := range bodies {
+		var parsed struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(b), &parsed))
+		counts = append(counts, len(parsed.Data))
+	}
+	return counts
+}
+
+func getOdooRecords(n int) []odoo.OdooMeteredBillingRecord {
+	records := make([]odoo.OdooMeteredBillingRecord, n)
+	for i := range records {
+		records[i] = getOdooRecord()
+		records[i].InstanceID = fmt.Sprintf("instance-%d", i)
+	}
+	return records
+}
@@ -0,0 +1,47 @@
+package odoo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// DryRunClient writes the records to a writer instead of sending them to the Odoo API.
+// Each call to SendData writes the exact request bodies OdooAPIClient would have sent, each followed by a newline.
+// The records are split into multiple request bodies in the same way as OdooAPIClient does for the given options.
+// The resulting output is in the JSON Lines format.
+// DryRunClient is safe for concurrent use.
+type DryRunClient struct {
+	out     io.Writer
+	logger  logr.Logger
+	options options
+
+	mu sync.Mutex
+}
+
+func NewDryRunClient(out io.Writer, logger logr.Logger, opts ...Option) *DryRunClient {
+	return &DryRunClient{
+		out:     out,
+		logger:  logger,
+		options: buildOptions(opts),
+	}
+}
+
+func (c *DryRunClient) SendData(_ context.Context, data []OdooMeteredBillingRecord) error {
+	chunks, err := splitRecords(data, c.options.maxRecordsPerRequest, c.options.maxRequestBodySize)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, chunk := range chunks {
+		if _, err := c.out.Write(append(chunk.body, '\n')); err != nil {
+			return fmt.Errorf("failed to write records: %w", err)
+		}
+	}
+	c.logger.Info("Records written instead of sending them to Odoo API (dry-run)", "numberOfRecords", len(data), "numberOfRequests", len(chunks))
+	return nil
+}
@@ -0,0 +1,23 @@
+package odoo_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+func TestDryRunWritesRequestBody(t *testing.T) {
+	out := &bytes.Buffer{}
+	uut := odoo.NewDryRunClient(out, logr.Discard())
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()}))
+	require.NoError(t, uut.SendData(context.Background(), nil))
+
+	require.Equal(t, `{"data":[{"product_id":"my-product","instance_id":"my-instance","item_description":"my-description","item_group_description":"my-group","sales_order_id":"SO00000","unit_id":"my-unit","consumed_units":11.1,"timerange":"2022-02-22T22:22:22Z/2022-02-22T23:22:22Z"}]}`+"\n"+
+		`{"data":[]}`+"\n", out.String())
+}
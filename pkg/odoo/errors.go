@@ -0,0 +1,93 @@
+package odoo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError is returned if the Odoo API rejected a request.
+type APIError struct {
+	StatusCode int
+	// Name is the name of the exception reported by Odoo, for example `builtins.KeyError`.
+	Name    string
+	Message string
+	// RecordErrors contains the errors of individual records, if reported by the API.
+	RecordErrors []RecordError
+	// Body is the raw response body.
+	Body string
+}
+
+// RecordError is an error of an individual record reported by the Odoo API.
+type RecordError struct {
+	// Index is the index of the record in the records passed to SendData.
+	Index   int    `json:"index"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "API error when sending records to Odoo: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Name != "" {
+		fmt.Fprintf(b, ": %s", e.Name)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(b, ": %s", e.Message)
+	}
+	if len(e.RecordErrors) > 0 {
+		fmt.Fprintf(b, " (%d records rejected)", len(e.RecordErrors))
+	}
+	return b.String()
+}
+
+func (e RecordError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// apiErrorBody is the JSON error payload returned by the Odoo API.
+// Some endpoints wrap it in an `error` object.
+type apiErrorBody struct {
+	Name    string        `json:"name"`
+	Message string        `json:"message"`
+	Errors  []RecordError `json:"errors"`
+	Error   *apiErrorBody `json:"error"`
+}
+
+// parseAPIError creates an APIError from the response status code and body.
+// If the body is not a JSON error payload, it is used as the message.
+func parseAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: statusCode,
+		Body:       string(body),
+	}
+	var parsed apiErrorBody
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		apiErr.Message = strings.TrimSpace(string(body))
+		return apiErr
+	}
+	if parsed.Error != nil {
+		parsed = *parsed.Error
+	}
+	apiErr.Name = parsed.Name
+	apiErr.Message = parsed.Message
+	apiErr.RecordErrors = parsed.Errors
+	return apiErr
+}
+
+// offsetRecordErrors shifts the record indices of an APIError by the given offset.
+// This maps the indices reported for a chunk to indices of all records passed to SendData.
+func offsetRecordErrors(err error, offset int) {
+	var apiErr *APIError
+	if offset == 0 || !errors.As(err, &apiErr) {
+		return
+	}
+	for i := range apiErr.RecordErrors {
+		apiErr.RecordErrors[i].Index += offset
+	}
+}
@@ -0,0 +1,84 @@
+package odoo_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+func TestAPIErrorFromOdooException(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.WriteHeader(500)
+	recorder.WriteString(`{"arguments":["data"],"code":500,"context":{},"message":"data","name":"builtins.KeyError","traceback":[]}`)
+	client := http.Client{Transport: &mockRoundTripper{cannedResponse: recorder.Result()}}
+
+	uut := odoo.NewOdooAPIWithClient("https://foo.bar/odoo16/", &client, logr.Discard())
+	err := uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()})
+
+	var apiErr *odoo.APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, 500, apiErr.StatusCode)
+	require.Equal(t, "builtins.KeyError", apiErr.Name)
+	require.Equal(t, "data", apiErr.Message)
+	require.Empty(t, apiErr.RecordErrors)
+	require.EqualError(t, err, "API error when sending records to Odoo: 500 Internal Server Error: builtins.KeyError: data")
+}
+
+func TestAPIErrorWithRecordErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"name":"odoo.exceptions.ValidationError","message":"invalid records","errors":[{"index":1,"field":"sales_order_id","message":"unknown sales order"}]}}`))
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithMaxRecordsPerRequest(2))
+	err := uut.SendData(context.Background(), getOdooRecords(3))
+
+	var apiErr *odoo.APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	require.Equal(t, "odoo.exceptions.ValidationError", apiErr.Name)
+	require.Equal(t, []odoo.RecordError{{Index: 1, Field: "sales_order_id", Message: "unknown sales order"}}, apiErr.RecordErrors)
+}
+
+func TestAPIErrorRecordIndexOfLaterChunk(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"invalid records","errors":[{"index":0,"field":"unit_id","message":"unknown unit"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithMaxRecordsPerRequest(2))
+	err := uut.SendData(context.Background(), getOdooRecords(3))
+
+	var apiErr *odoo.APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, 2, apiErr.RecordErrors[0].Index, "index should refer to all records, not the chunk")
+}
+
+func TestAPIErrorWithPlainTextBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte("payload too large\n"))
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard())
+	err := uut.SendData(context.Background(), getOdooRecords(1))
+
+	var apiErr *odoo.APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, "payload too large", apiErr.Message)
+	require.Equal(t, "payload too large\n", apiErr.Body)
+}
@@ -8,16 +8,22 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/appuio/appuio-reporting/pkg/retry"
 )
 
 type OdooAPIClient struct {
 	odooURL     string
 	logger      logr.Logger
 	oauthClient *http.Client
+	options     options
 }
 
 type apiObject struct {
@@ -44,11 +50,29 @@ func (t Timerange) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + t.From.Format(time.RFC3339) + "/" + t.To.Format(time.RFC3339) + `"`), nil
 }
 
-func (t *Timerange) UnmarshalJSON([]byte) error {
-	return errors.New("Not implemented")
+// UnmarshalJSON parses a timerange in the form of "from/to" as written by MarshalJSON.
+func (t *Timerange) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	from, to, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("invalid timerange %q, expected from/to", s)
+	}
+	f, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return fmt.Errorf("invalid timerange %q: %w", s, err)
+	}
+	u, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return fmt.Errorf("invalid timerange %q: %w", s, err)
+	}
+	t.From, t.To = f, u
+	return nil
 }
 
-func NewOdooAPIClient(ctx context.Context, odooURL string, oauthTokenURL string, oauthClientId string, oauthClientSecret string, logger logr.Logger) *OdooAPIClient {
+func NewOdooAPIClient(ctx context.Context, odooURL string, oauthTokenURL string, oauthClientId string, oauthClientSecret string, logger logr.Logger, opts ...Option) *OdooAPIClient {
 	oauthConfig := clientcredentials.Config{
 		ClientID:     oauthClientId,
 		ClientSecret: oauthClientSecret,
@@ -59,38 +83,146 @@ func NewOdooAPIClient(ctx context.Context, odooURL string, oauthTokenURL string,
 		odooURL:     odooURL,
 		logger:      logger,
 		oauthClient: oauthClient,
+		options:     buildOptions(opts),
 	}
 }
 
-func NewOdooAPIWithClient(odooURL string, client *http.Client, logger logr.Logger) *OdooAPIClient {
+func NewOdooAPIWithClient(odooURL string, client *http.Client, logger logr.Logger, opts ...Option) *OdooAPIClient {
 	return &OdooAPIClient{
 		odooURL:     odooURL,
 		logger:      logger,
 		oauthClient: client,
+		options:     buildOptions(opts),
 	}
 }
 
+// SendData sends the records to the Odoo API.
+// The records are split into multiple requests if a maximum number of records per request or a maximum request body size is configured.
+// If sending a chunk fails, the returned error is a *ChunkError and the remaining chunks are not sent.
+// Errors returned by the API can be retrieved as *APIError using errors.As.
 func (c OdooAPIClient) SendData(ctx context.Context, data []OdooMeteredBillingRecord) error {
-	apiObject := apiObject{
-		Data: ensureJSONArray[OdooMeteredBillingRecord](data),
-	}
-	str, err := json.Marshal(apiObject)
+	chunks, err := splitRecords(data, c.options.maxRecordsPerRequest, c.options.maxRequestBodySize)
 	if err != nil {
 		return err
 	}
-	resp, err := c.oauthClient.Post(c.odooURL, "application/json", bytes.NewBuffer(str))
+	if len(chunks) == 1 {
+		return c.sendChunk(ctx, chunks[0])
+	}
+	for i, chunk := range chunks {
+		if err := c.sendChunk(ctx, chunk); err != nil {
+			offsetRecordErrors(err, chunk.offset)
+			return &ChunkError{
+				Chunk:  i + 1,
+				Chunks: len(chunks),
+				Offset: chunk.offset,
+				Count:  len(chunk.records),
+				Err:    err,
+			}
+		}
+	}
+	return nil
+}
+
+func (c OdooAPIClient) sendChunk(ctx context.Context, chunk chunk) error {
+	policy := c.options.retryPolicy
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := c.post(ctx, chunk.body, len(chunk.records))
+		if err == nil {
+			return nil
+		}
+		var rerr retryableError
+		if !errors.As(err, &rerr) {
+			return err
+		}
+		if attempt > policy.MaxRetries {
+			if attempt > 1 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		backoff := policy.Backoff(attempt)
+		if retryAfter > 0 {
+			backoff = retryAfter
+			// A misbehaving server must not be able to stall the run indefinitely.
+			if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+		c.logger.Info("Sending records to Odoo API failed, retrying", "error", err.Error(), "attempt", attempt, "backoff", backoff)
+		if err := retry.Sleep(ctx, backoff); err != nil {
+			return fmt.Errorf("aborted retrying after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+// post sends the body to the Odoo API.
+// Errors that might be resolved by retrying the request are wrapped in a retryableError.
+// If the API returned a Retry-After header, the parsed duration is returned.
+func (c OdooAPIClient) post(ctx context.Context, body []byte, numberOfRecords int) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.odooURL, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.oauthClient.Do(req)
+	if err != nil {
+		c.options.metrics.ObserveOdooRequest(0)
+		if ctx.Err() != nil {
+			return 0, err
+		}
+		// Retrying does not help if the token endpoint rejected the client credentials.
+		var tokenErr *oauth2.RetrieveError
+		if errors.As(err, &tokenErr) && tokenErr.Response != nil && tokenErr.Response.StatusCode < 500 {
+			return 0, fmt.Errorf("failed to authenticate with Odoo: %w", err)
+		}
+		return 0, retryableError{err}
 	}
 	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	c.logger.Info("Records sent to Odoo API", "status", resp.Status, "body", string(body), "numberOfRecords", len(data))
+	c.options.metrics.ObserveOdooRequest(resp.StatusCode)
+	respBody, _ := io.ReadAll(resp.Body)
+	c.logger.Info("Records sent to Odoo API", "status", resp.Status, "body", string(respBody), "numberOfRecords", numberOfRecords)
 
 	if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("API error when sending records to Odoo:\n%s", body))
+		err := parseAPIError(resp.StatusCode, respBody)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return parseRetryAfter(resp.Header.Get("Retry-After")), retryableError{err}
+		}
+		return 0, err
 	}
 
-	return nil
+	return 0, nil
+}
+
+// retryableError marks errors that might be resolved by retrying the request.
+type retryableError struct {
+	error
+}
+
+func (e retryableError) Unwrap() error {
+	return e.error
+}
+
+// parseRetryAfter parses the value of a Retry-After header, given either in seconds or as a HTTP date.
+// Returns 0 if the value is empty or invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// marshalRequestBody returns the JSON request body for the given records as expected by the Odoo API.
+func marshalRequestBody(data []OdooMeteredBillingRecord) ([]byte, error) {
+	return json.Marshal(apiObject{
+		Data: ensureJSONArray[OdooMeteredBillingRecord](data),
+	})
 }
 
 // ensureJSONArray is a wrapper around any slice that will marshal to an empty array instead of `null` if the array is nil.
@@ -2,17 +2,23 @@ package odoo_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
+	"github.com/appuio/appuio-reporting/pkg/metrics"
 	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/retry"
 )
 
 type mockRoundTripper struct {
@@ -129,3 +135,170 @@ func getOdooRecord() odoo.OdooMeteredBillingRecord {
 		},
 	}
 }
+
+func TestRecordJSONRoundTrip(t *testing.T) {
+	r := getOdooRecord()
+	r.Timerange.From = r.Timerange.From.Truncate(time.Second)
+	r.Timerange.To = r.Timerange.To.Truncate(time.Second)
+	b, err := json.Marshal(r)
+	require.NoError(t, err)
+
+	var decoded odoo.OdooMeteredBillingRecord
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, r, decoded)
+
+	require.Error(t, json.Unmarshal([]byte(`"2022-02-22T22:00:00Z"`), &decoded.Timerange))
+	require.Error(t, json.Unmarshal([]byte(`"2022-02-22T22:00:00Z/tomorrow"`), &decoded.Timerange))
+}
+
+func TestRetriesOnServerErrors(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithRetryPolicy(retry.Policy{MaxRetries: 3, InitialBackoff: time.Millisecond}))
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()}))
+	require.Equal(t, 3, requests)
+}
+
+func TestRecordsStatusCodesInMetrics(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	m := metrics.New()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, m.Register(registry))
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(),
+		odoo.WithRetryPolicy(retry.Policy{MaxRetries: 3, InitialBackoff: time.Millisecond}),
+		odoo.WithMetrics(m),
+	)
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()}))
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP appuio_reporting_odoo_requests_total Number of requests sent to the Odoo API by status code. The code is "error" if no response was received.
+# TYPE appuio_reporting_odoo_requests_total counter
+appuio_reporting_odoo_requests_total{code="200"} 1
+appuio_reporting_odoo_requests_total{code="502"} 1
+`), "appuio_reporting_odoo_requests_total"))
+}
+
+func TestRetriesGiveUpAfterMaxRetries(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithRetryPolicy(retry.Policy{MaxRetries: 2, InitialBackoff: time.Millisecond}))
+
+	err := uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()})
+	require.ErrorContains(t, err, "giving up after 3 attempts")
+	require.Equal(t, 3, requests)
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithRetryPolicy(retry.Policy{MaxRetries: 3, InitialBackoff: time.Millisecond}))
+
+	require.Error(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()}))
+	require.Equal(t, 1, requests)
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithRetryPolicy(retry.Policy{MaxRetries: 1, InitialBackoff: time.Millisecond}))
+
+	started := time.Now()
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()}))
+	require.Equal(t, 2, requests)
+	require.GreaterOrEqual(t, time.Since(started), time.Second)
+}
+
+func TestRetryAfterIsCappedAtMaxBackoff(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 2 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIWithClient(srv.URL, srv.Client(), logr.Discard(), odoo.WithRetryPolicy(retry.Policy{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}))
+
+	started := time.Now()
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()}))
+	require.Equal(t, 2, requests)
+	require.Less(t, time.Since(started), time.Second)
+}
+
+func TestDoesNotRetryRejectedCredentials(t *testing.T) {
+	tokenRequests, requests := 0, 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"error":"invalid_client"}`)
+	})
+	mux.HandleFunc("/odoo", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	uut := odoo.NewOdooAPIClient(context.Background(), srv.URL+"/odoo", srv.URL+"/token", "id", "secret", logr.Discard(), odoo.WithRetryPolicy(retry.Policy{MaxRetries: 3, InitialBackoff: time.Millisecond}))
+
+	err := uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()})
+	require.ErrorContains(t, err, "failed to authenticate with Odoo")
+	require.ErrorContains(t, err, "invalid_client")
+	// The oauth2 client tries both ways of passing the credentials in the first attempt.
+	require.LessOrEqual(t, tokenRequests, 2)
+	require.Equal(t, 0, requests)
+}
+
+func TestRetriesTransportErrors(t *testing.T) {
+	client := http.Client{Transport: &mockRoundTripperWhichFails{}}
+
+	uut := odoo.NewOdooAPIWithClient("https://foo.bar/odoo16/", &client, logr.Discard(), odoo.WithRetryPolicy(retry.Policy{MaxRetries: 2, InitialBackoff: time.Millisecond}))
+
+	require.ErrorContains(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getOdooRecord()}), "giving up after 3 attempts")
+}
@@ -0,0 +1,73 @@
+package odoo
+
+import (
+	"github.com/appuio/appuio-reporting/pkg/metrics"
+	"github.com/appuio/appuio-reporting/pkg/retry"
+)
+
+type options struct {
+	retryPolicy          retry.Policy
+	maxRecordsPerRequest int
+	maxRequestBodySize   int
+	metrics              *metrics.Metrics
+}
+
+// Option represents an Odoo client option.
+type Option interface {
+	set(*options)
+}
+
+func buildOptions(os []Option) options {
+	var build options
+	for _, o := range os {
+		o.set(&build)
+	}
+	return build
+}
+
+// WithRetryPolicy allows retrying requests that failed with a transport error, a 5xx or a 429 response.
+// Requests rejected with any other status code are not retried.
+func WithRetryPolicy(p retry.Policy) Option {
+	return retryPolicy(p)
+}
+
+type retryPolicy retry.Policy
+
+func (p retryPolicy) set(o *options) {
+	o.retryPolicy = retry.Policy(p)
+}
+
+// WithMaxRecordsPerRequest allows splitting the records into multiple requests with at most n records each.
+func WithMaxRecordsPerRequest(n int) Option {
+	return maxRecordsPerRequest(n)
+}
+
+type maxRecordsPerRequest int
+
+func (n maxRecordsPerRequest) set(o *options) {
+	o.maxRecordsPerRequest = int(n)
+}
+
+// WithMaxRequestBodySize allows splitting the records into multiple requests with a body of at most n bytes each.
+func WithMaxRequestBodySize(n int) Option {
+	return maxRequestBodySize(n)
+}
+
+type maxRequestBodySize int
+
+func (n maxRequestBodySize) set(o *options) {
+	o.maxRequestBodySize = int(n)
+}
+
+// WithMetrics allows recording the status codes of the requests to the Odoo API in the given metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return metricsOption{m}
+}
+
+type metricsOption struct {
+	*metrics.Metrics
+}
+
+func (m metricsOption) set(o *options) {
+	o.metrics = m.Metrics
+}
@@ -0,0 +1,143 @@
+package report
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Alignment defines where the timeranges of a report start and how they are stepped.
+type Alignment string
+
+const (
+	// AlignAuto derives the alignment from the timerange size: AlignDay for multiples of 24 hours,
+	// AlignHour for multiples of an hour and AlignDuration otherwise. An empty Alignment is treated as AlignAuto.
+	AlignAuto Alignment = "auto"
+	// AlignMinute starts timeranges at full minutes.
+	AlignMinute Alignment = "minute"
+	// AlignHour starts timeranges at full hours.
+	AlignHour Alignment = "hour"
+	// AlignDay starts timeranges at midnight in the location of the report.
+	// Timeranges are stepped in calendar days, so that they stay aligned across daylight saving time changes.
+	AlignDay Alignment = "day"
+	// AlignMonth starts timeranges on the first day of a calendar month in the location of the report.
+	// Each timerange spans one calendar month, the timerange size is ignored.
+	AlignMonth Alignment = "month"
+	// AlignDuration starts timeranges at multiples of the timerange size since the Unix epoch.
+	AlignDuration Alignment = "duration"
+)
+
+// Alignments are all supported alignments.
+var Alignments = []Alignment{AlignAuto, AlignMinute, AlignHour, AlignDay, AlignMonth, AlignDuration}
+
+// ParseAlignment parses the alignment.
+func ParseAlignment(s string) (Alignment, error) {
+	for _, a := range Alignments {
+		if string(a) == s {
+			return a, nil
+		}
+	}
+	names := make([]string, len(Alignments))
+	for i, a := range Alignments {
+		names[i] = string(a)
+	}
+	return "", fmt.Errorf("unknown alignment %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// alignment returns the effective alignment of the report.
+func (args ReportArgs) alignment() Alignment {
+	if args.Alignment != "" && args.Alignment != AlignAuto {
+		return args.Alignment
+	}
+	switch {
+	case args.TimerangeSize > 0 && args.TimerangeSize%(24*time.Hour) == 0:
+		return AlignDay
+	case args.TimerangeSize > 0 && args.TimerangeSize%time.Hour == 0:
+		return AlignHour
+	}
+	return AlignDuration
+}
+
+// location returns the location of the report, UTC if not set.
+func (args ReportArgs) location() *time.Location {
+	if args.Location == nil {
+		return time.UTC
+	}
+	return args.Location
+}
+
+// alignmentUnits are the units the timerange size has to be a multiple of, by alignment.
+var alignmentUnits = map[Alignment]time.Duration{
+	AlignMinute: time.Minute,
+	AlignHour:   time.Hour,
+	AlignDay:    24 * time.Hour,
+}
+
+// CheckTimerange returns an error if the timerange size does not fit the alignment of the report.
+// The timerange size has to be positive and, with AlignMinute, AlignHour and AlignDay, a multiple of a minute, an hour or 24 hours respectively,
+// so that every timerange starts aligned. The timerange size is ignored with AlignMonth.
+func (args ReportArgs) CheckTimerange() error {
+	a := args.alignment()
+	if a == AlignMonth {
+		return nil
+	}
+	if args.TimerangeSize <= 0 {
+		return fmt.Errorf("timerange should be a positive duration unless the alignment is %s, got: %s", AlignMonth, args.TimerangeSize)
+	}
+	if unit, ok := alignmentUnits[a]; ok && args.TimerangeSize%unit != 0 {
+		return fmt.Errorf("timerange should be a multiple of %s with alignment %s, got: %s", unit, a, args.TimerangeSize)
+	}
+	return nil
+}
+
+// TimerangeEnd returns the end of the timerange starting at from, which is the start of the following timerange.
+// The timerange size has to be valid, see CheckTimerange.
+func (args ReportArgs) TimerangeEnd(from time.Time) time.Time {
+	switch args.alignment() {
+	case AlignMonth:
+		return from.In(args.location()).AddDate(0, 1, 0).UTC()
+	case AlignDay:
+		return from.In(args.location()).AddDate(0, 0, int(args.TimerangeSize/(24*time.Hour))).UTC()
+	}
+	return from.Add(args.TimerangeSize).UTC()
+}
+
+// AlignDown returns the latest timestamp that is aligned according to the alignment of the report and not after t.
+func (args ReportArgs) AlignDown(t time.Time) time.Time {
+	local := t.In(args.location())
+	switch args.alignment() {
+	case AlignMinute:
+		return t.Truncate(time.Minute).UTC()
+	case AlignHour:
+		return t.Truncate(time.Hour).UTC()
+	case AlignDay:
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location()).UTC()
+	case AlignMonth:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, local.Location()).UTC()
+	}
+	if args.TimerangeSize <= 0 {
+		return t.UTC()
+	}
+	return time.Unix(0, 0).Add(t.Sub(time.Unix(0, 0)) / args.TimerangeSize * args.TimerangeSize).UTC()
+}
+
+// CheckAlignment returns an error if the timestamp is not aligned according to the alignment of the report.
+// It also returns an error if the timerange size does not fit the alignment, see CheckTimerange.
+func (args ReportArgs) CheckAlignment(t time.Time) error {
+	if err := args.CheckTimerange(); err != nil {
+		return err
+	}
+	if args.AlignDown(t).Equal(t) {
+		return nil
+	}
+	switch a := args.alignment(); a {
+	case AlignDuration:
+		return fmt.Errorf("timestamp should be a multiple of the timerange %s, got: %s", args.TimerangeSize, t.Format(time.RFC3339Nano))
+	case AlignMinute:
+		return fmt.Errorf("timestamp should only contain full minutes, got: %s", t.Format(time.RFC3339Nano))
+	case AlignHour:
+		return fmt.Errorf("timestamp should only contain full hours based on UTC, got: %s", t.Format(time.RFC3339Nano))
+	default:
+		return fmt.Errorf("timestamp should be at the start of a %s in %s, got: %s", a, args.location(), t.Format(time.RFC3339Nano))
+	}
+}
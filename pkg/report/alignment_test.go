@@ -0,0 +1,136 @@
+package report_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+func TestReportArgs_CheckAlignment(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	require.NoError(t, err)
+
+	tcs := map[string]struct {
+		args       report.ReportArgs
+		aligned    []time.Time
+		notAligned []time.Time
+	}{
+		"auto hourly": {
+			args:       report.ReportArgs{TimerangeSize: time.Hour},
+			aligned:    []time.Time{time.Date(2023, 7, 8, 13, 0, 0, 0, time.UTC)},
+			notAligned: []time.Time{time.Date(2023, 7, 8, 13, 1, 0, 0, time.UTC)},
+		},
+		"auto 15 minutes": {
+			args:       report.ReportArgs{TimerangeSize: 15 * time.Minute},
+			aligned:    []time.Time{time.Date(2023, 7, 8, 13, 45, 0, 0, time.UTC)},
+			notAligned: []time.Time{time.Date(2023, 7, 8, 13, 10, 0, 0, time.UTC)},
+		},
+		"auto daily in timezone": {
+			args:       report.ReportArgs{TimerangeSize: 24 * time.Hour, Location: zurich},
+			aligned:    []time.Time{time.Date(2023, 7, 7, 22, 0, 0, 0, time.UTC)},
+			notAligned: []time.Time{time.Date(2023, 7, 8, 0, 0, 0, 0, time.UTC)},
+		},
+		"minute": {
+			args:       report.ReportArgs{TimerangeSize: 15 * time.Minute, Alignment: report.AlignMinute},
+			aligned:    []time.Time{time.Date(2023, 7, 8, 13, 10, 0, 0, time.UTC)},
+			notAligned: []time.Time{time.Date(2023, 7, 8, 13, 10, 30, 0, time.UTC)},
+		},
+		"month": {
+			args:       report.ReportArgs{Alignment: report.AlignMonth},
+			aligned:    []time.Time{time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)},
+			notAligned: []time.Time{time.Date(2023, 7, 2, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			for _, ts := range tc.aligned {
+				require.NoError(t, tc.args.CheckAlignment(ts), ts)
+			}
+			for _, ts := range tc.notAligned {
+				require.Error(t, tc.args.CheckAlignment(ts), ts)
+			}
+		})
+	}
+}
+
+func TestReportArgs_TimerangeEnd(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	require.NoError(t, err)
+
+	monthly := report.ReportArgs{Alignment: report.AlignMonth, Location: zurich}
+	// Midnight of February 1st in Zurich.
+	from := time.Date(2023, 1, 31, 23, 0, 0, 0, time.UTC)
+	require.Equal(t, time.Date(2023, 2, 28, 23, 0, 0, 0, time.UTC), monthly.TimerangeEnd(from))
+
+	daily := report.ReportArgs{TimerangeSize: 24 * time.Hour, Location: zurich}
+	// The day daylight saving time starts only has 23 hours.
+	from = time.Date(2023, 3, 25, 23, 0, 0, 0, time.UTC)
+	require.Equal(t, time.Date(2023, 3, 26, 22, 0, 0, 0, time.UTC), daily.TimerangeEnd(from))
+}
+
+func TestReportArgs_CheckTimerange(t *testing.T) {
+	valid := []report.ReportArgs{
+		{TimerangeSize: 48 * time.Hour, Alignment: report.AlignDay},
+		{TimerangeSize: 2 * time.Hour, Alignment: report.AlignHour},
+		{TimerangeSize: 15 * time.Minute, Alignment: report.AlignMinute},
+		{TimerangeSize: 90 * time.Second, Alignment: report.AlignDuration},
+		{TimerangeSize: 15 * time.Minute},
+		{Alignment: report.AlignMonth},
+	}
+	for _, args := range valid {
+		require.NoError(t, args.CheckTimerange(), "%s %s", args.Alignment, args.TimerangeSize)
+	}
+
+	invalid := map[string]report.ReportArgs{
+		"timerange should be a multiple of 24h0m0s with alignment day, got: 1h0m0s":  {TimerangeSize: time.Hour, Alignment: report.AlignDay},
+		"timerange should be a multiple of 24h0m0s with alignment day, got: 36h0m0s": {TimerangeSize: 36 * time.Hour, Alignment: report.AlignDay},
+		"timerange should be a multiple of 1h0m0s with alignment hour, got: 15m0s":   {TimerangeSize: 15 * time.Minute, Alignment: report.AlignHour},
+		"timerange should be a multiple of 1m0s with alignment minute, got: 1m30s":   {TimerangeSize: 90 * time.Second, Alignment: report.AlignMinute},
+		"timerange should be a positive duration unless the alignment is month":      {Alignment: report.AlignHour},
+		"timerange should be a positive duration unless the alignment is month, got": {TimerangeSize: -time.Hour},
+	}
+	for msg, args := range invalid {
+		require.ErrorContains(t, args.CheckTimerange(), msg)
+	}
+}
+
+func TestReport_RunRange_RejectsTimerangeNotMultipleOfAlignment(t *testing.T) {
+	args := getReportArgs()
+	args.TimerangeSize = time.Hour
+	args.Alignment = report.AlignDay
+
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := report.RunRange(context.Background(), &MockOdooClient{}, staticQuerier{}, args, from, from.AddDate(0, 0, 2))
+	require.ErrorContains(t, err, "timerange should be a multiple of 24h0m0s with alignment day")
+	require.ErrorContains(t, report.Run(context.Background(), &MockOdooClient{}, staticQuerier{}, args, from), "timerange should be a multiple")
+}
+
+func TestReport_RunRangeMonthly(t *testing.T) {
+	o := &MockOdooClient{}
+	args := getReportArgs()
+	args.TimerangeSize = 0
+	args.Alignment = report.AlignMonth
+
+	n, err := report.RunRange(context.Background(), o, staticQuerier{sample("SO1", "a", 1)}, args,
+		time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), o.lastReceivedData[0].Timerange.From)
+	require.Equal(t, time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC), o.lastReceivedData[0].Timerange.To)
+
+	require.ErrorContains(t, report.Run(context.Background(), o, staticQuerier{}, args, time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)),
+		"timestamp should be at the start of a month in UTC")
+}
+
+func TestParseAlignment(t *testing.T) {
+	a, err := report.ParseAlignment("day")
+	require.NoError(t, err)
+	require.Equal(t, report.AlignDay, a)
+
+	_, err = report.ParseAlignment("week")
+	require.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/appuio/appuio-reporting/pkg/atomicfile"
+)
+
+// Checkpoint records the progress of RunRange.
+type Checkpoint struct {
+	ProductID string `json:"productId"`
+	// LastDelivered is the start of the last timerange that has been delivered completely.
+	LastDelivered time.Time `json:"lastDelivered"`
+}
+
+// Next returns the start of the timerange following the last delivered one.
+func (c Checkpoint) Next(args ReportArgs) time.Time {
+	return args.TimerangeEnd(c.LastDelivered)
+}
+
+// ReadCheckpoint reads the checkpoint from the given file.
+// Returns false if the file does not exist.
+func ReadCheckpoint(path string) (Checkpoint, bool, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, false, nil
+	}
+	if err != nil {
+		return Checkpoint{}, false, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var c Checkpoint
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return Checkpoint{}, false, fmt.Errorf("failed to parse checkpoint %q: %w", path, err)
+	}
+	return c, true, nil
+}
+
+// WriteCheckpoint atomically writes the checkpoint to the given file.
+func WriteCheckpoint(path string, c Checkpoint) error {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(path, raw); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// ResumeFrom returns the timestamp to resume a report range from.
+// This is the timestamp following the checkpoint in the given file, or begin if the file does not exist.
+// Returns an error if the checkpoint belongs to a different product.
+func ResumeFrom(path string, args ReportArgs, begin time.Time) (time.Time, error) {
+	c, ok, err := ReadCheckpoint(path)
+	if err != nil || !ok {
+		return begin, err
+	}
+	if c.ProductID != args.ProductID {
+		return time.Time{}, fmt.Errorf("checkpoint %q belongs to product %q, not %q", path, c.ProductID, args.ProductID)
+	}
+	return c.Next(args), nil
+}
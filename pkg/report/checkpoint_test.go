@@ -0,0 +1,98 @@
+package report_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+func TestRunRange_WritesCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	prom := staticQuerier{sample("SO00000", "instance-a", 1)}
+	o := &OdooClientFailingAfter{n: 2}
+	args := getReportArgs()
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	_, err := report.RunRange(context.Background(), o, prom, args, base, base.Add(4*time.Hour), report.WithCheckpointFile(path))
+	require.Error(t, err)
+
+	c, ok, err := report.ReadCheckpoint(path)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, report.Checkpoint{ProductID: args.ProductID, LastDelivered: base.Add(time.Hour)}, c)
+
+	resumeFrom, err := report.ResumeFrom(path, args, base)
+	require.NoError(t, err)
+	require.Equal(t, base.Add(2*time.Hour), resumeFrom)
+}
+
+func TestRunRange_WritesCheckpointAfterLaterFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	prom := staticQuerier{sample("SO00000", "instance-a", 1)}
+	args := getReportArgs()
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+	o := &OdooClientSucceedingAfterFailure{failAt: base.Add(time.Hour), failed: make(chan struct{})}
+
+	s, err := report.RunRangeWithSummary(context.Background(), o, prom, args, base, base.Add(2*time.Hour),
+		report.WithConcurrency(2),
+		report.WithCheckpointFile(path),
+	)
+	require.ErrorContains(t, err, "error running report at 2020-01-23T18:00:00Z")
+	require.Equal(t, []time.Time{base}, s.Succeeded)
+
+	c, ok, err := report.ReadCheckpoint(path)
+	require.NoError(t, err)
+	require.True(t, ok, "the report finishing after the failure must be checkpointed")
+	require.Equal(t, base, c.LastDelivered)
+}
+
+func TestResumeFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	args := getReportArgs()
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	resumeFrom, err := report.ResumeFrom(path, args, base)
+	require.NoError(t, err)
+	require.Equal(t, base, resumeFrom, "should start at begin without checkpoint")
+
+	require.NoError(t, report.WriteCheckpoint(path, report.Checkpoint{ProductID: "other-product", LastDelivered: base}))
+	_, err = report.ResumeFrom(path, args, base)
+	require.ErrorContains(t, err, "belongs to product")
+}
+
+// OdooClientFailingAfter fails all calls after the first n calls.
+type OdooClientFailingAfter struct {
+	n     int
+	calls int
+}
+
+func (c *OdooClientFailingAfter) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	c.calls++
+	if c.calls > c.n {
+		return errors.New("odoo is down")
+	}
+	return nil
+}
+
+// OdooClientSucceedingAfterFailure fails for records starting at failAt.
+// All other records are only accepted after that failure.
+type OdooClientSucceedingAfterFailure struct {
+	failAt time.Time
+	failed chan struct{}
+}
+
+func (c *OdooClientSucceedingAfterFailure) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	if len(data) > 0 && data[0].Timerange.From.Equal(c.failAt) {
+		close(c.failed)
+		return errors.New("odoo is down")
+	}
+	<-c.failed
+	return nil
+}
@@ -0,0 +1,68 @@
+package report
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/google/go-jsonnet"
+	"github.com/prometheus/common/model"
+)
+
+// Names of the external variables available to the Jsonnet snippets.
+const (
+	// ExtVarLabels holds the labels of the sample as object.
+	ExtVarLabels = "labels"
+	// ExtVarFrom holds the start of the timerange in the form of RFC3339.
+	ExtVarFrom = "from"
+	// ExtVarTo holds the end of the timerange in the form of RFC3339.
+	ExtVarTo = "to"
+	// ExtVarValue holds the value of the sample as number, or null if it is not a finite number.
+	ExtVarValue = "value"
+	// ExtVarProductID holds the product ID of the record.
+	ExtVarProductID = "productId"
+	// ExtVarUnitID holds the unit ID of the record.
+	ExtVarUnitID = "unitId"
+)
+
+// ReservedExtVars are the names of the external variables set for every sample. They can't be used for JsonnetExtVars.
+var ReservedExtVars = []string{ExtVarLabels, ExtVarFrom, ExtVarTo, ExtVarValue, ExtVarProductID, ExtVarUnitID}
+
+// newJsonnetImporter returns an importer resolving imports relative to the working directory and the Jsonnet library paths of the report arguments.
+// The importer caches the imported files. It is not safe for concurrent use, so it must not be shared between reports running concurrently.
+func newJsonnetImporter(args ReportArgs) jsonnet.Importer {
+	return &jsonnet.FileImporter{JPaths: args.JsonnetLibraryPaths}
+}
+
+// newJsonnetVM returns a Jsonnet VM to evaluate the snippets of the report arguments for a sample.
+// The sample and the timerange are available as the external variables listed in ReservedExtVars, together with the JsonnetExtVars of the report arguments.
+// The product and unit ID are the static IDs of the report arguments. They have to be updated once computed by Jsonnet.
+// Imports are resolved by the given importer, see newJsonnetImporter.
+func newJsonnetVM(args ReportArgs, importer jsonnet.Importer, from time.Time, s *model.Sample) (*jsonnet.VM, error) {
+	labelList, err := json.Marshal(s.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(importer)
+	for k, v := range args.JsonnetExtVars {
+		vm.ExtVar(k, v)
+	}
+	vm.ExtCode(ExtVarLabels, string(labelList))
+	vm.ExtVar(ExtVarFrom, from.Format(time.RFC3339))
+	vm.ExtVar(ExtVarTo, args.TimerangeEnd(from).Format(time.RFC3339))
+	vm.ExtCode(ExtVarValue, jsonnetNumber(float64(s.Value)))
+	vm.ExtVar(ExtVarProductID, args.ProductID)
+	vm.ExtVar(ExtVarUnitID, args.UnitID)
+	return vm, nil
+}
+
+// jsonnetNumber returns the Jsonnet code for the number. Jsonnet has no representation of NaN and infinity, they are returned as null.
+func jsonnetNumber(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "null"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
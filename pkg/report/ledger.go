@@ -0,0 +1,65 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+// LedgerClient delivers records to a sink, skipping the records that have been delivered to it before according to the ledger.
+// Delivered records are recorded in the ledger, including the chunks delivered before a failed chunk.
+// Each sink needs its own ledger, so that a record delivered to one sink is still delivered to the others. See ledger.FileLedger.ForSink.
+type LedgerClient struct {
+	Client OdooClient
+	Ledger Ledger
+}
+
+// SendData sends the records that have not been delivered before.
+// The offset of a *odoo.ChunkError and the indices of rejected records refer to the given records, not only to the ones sent.
+func (c LedgerClient) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	pending := make([]odoo.OdooMeteredBillingRecord, 0, len(data))
+	indices := make([]int, 0, len(data))
+	for i, r := range data {
+		if !c.Ledger.Delivered(r) {
+			pending = append(pending, r)
+			indices = append(indices, i)
+		}
+	}
+	if len(pending) == 0 && len(data) > 0 {
+		// All records have been delivered before.
+		return nil
+	}
+
+	err := c.Client.SendData(ctx, pending)
+	if err == nil {
+		if err := c.Ledger.Record(pending); err != nil {
+			return fmt.Errorf("records were delivered but could not be recorded in the ledger: %w", err)
+		}
+		return nil
+	}
+
+	var chunkErr *odoo.ChunkError
+	if errors.As(err, &chunkErr) {
+		// Record the chunks that were delivered before the failed one, so that they are not sent again.
+		if chunkErr.Offset > 0 {
+			if lerr := c.Ledger.Record(pending[:chunkErr.Offset]); lerr != nil {
+				err = multierr.Append(err, fmt.Errorf("records were delivered but could not be recorded in the ledger: %w", lerr))
+			}
+		}
+		// The records skipped before the failed chunk have been delivered as well.
+		chunkErr.Offset = indices[chunkErr.Offset]
+	}
+	var apiErr *odoo.APIError
+	if errors.As(err, &apiErr) {
+		for i, re := range apiErr.RecordErrors {
+			if re.Index >= 0 && re.Index < len(indices) {
+				apiErr.RecordErrors[i].Index = indices[re.Index]
+			}
+		}
+	}
+	return err
+}
@@ -1,10 +1,24 @@
 package report
 
-import "time"
+import (
+	"time"
+
+	"github.com/appuio/appuio-reporting/pkg/metrics"
+	"github.com/appuio/appuio-reporting/pkg/retry"
+)
 
 type options struct {
 	prometheusQueryTimeout time.Duration
 	progressReporter       progressReporter
+	queryRetryPolicy       retry.Policy
+	queryRetryReporter     queryRetryReporter
+	checkpointFile         string
+	continueOnError        bool
+	concurrency            int
+	sampleErrorPolicy      SampleErrorPolicy
+	sampleErrorThreshold   float64
+	sampleErrorReporter    sampleErrorReporter
+	metrics                *metrics.Metrics
 }
 
 // Option represents a report option.
@@ -21,6 +35,7 @@ func buildOptions(os []Option) options {
 }
 
 // WithPrometheusQueryTimeout allows setting a timout when querying prometheus.
+// The timeout applies to each attempt if retries are enabled.
 func WithPrometheusQueryTimeout(tm time.Duration) Option {
 	return prometheusQueryTimeout(tm)
 }
@@ -31,10 +46,122 @@ func (t prometheusQueryTimeout) set(o *options) {
 	o.prometheusQueryTimeout = time.Duration(t)
 }
 
+// WithPrometheusQueryRetry allows retrying prometheus queries that failed with a retryable error.
+// See IsRetryableQueryError for the errors that are retried.
+func WithPrometheusQueryRetry(p retry.Policy) Option {
+	return queryRetryPolicy(p)
+}
+
+type queryRetryPolicy retry.Policy
+
+func (p queryRetryPolicy) set(o *options) {
+	o.queryRetryPolicy = retry.Policy(p)
+}
+
+// WithQueryRetryReporter allows setting a callback function.
+// The callback is called before a failed prometheus query is retried.
+func WithQueryRetryReporter(r func(QueryRetry)) Option {
+	return queryRetryReporter(r)
+}
+
+type queryRetryReporter func(QueryRetry)
+
+func (t queryRetryReporter) set(o *options) {
+	o.queryRetryReporter = t
+}
+
+// WithCheckpointFile allows persisting the progress of RunRange.
+// The file is updated with the last delivered timestamp after each successful report. See ResumeFrom.
+func WithCheckpointFile(path string) Option {
+	return checkpointFile(path)
+}
+
+type checkpointFile string
+
+func (f checkpointFile) set(o *options) {
+	o.checkpointFile = string(f)
+}
+
+// WithContinueOnError allows continuing a report range after a failed report.
+// The failures are collected in the RangeSummary returned by RunRangeWithSummary.
+func WithContinueOnError() Option {
+	return continueOnError(true)
+}
+
+type continueOnError bool
+
+func (c continueOnError) set(o *options) {
+	o.continueOnError = bool(c)
+}
+
+// WithConcurrency allows running up to n reports of a report range in parallel.
+// The remaining reports are cancelled on the first error unless WithContinueOnError() is set.
+func WithConcurrency(n int) Option {
+	return concurrency(n)
+}
+
+type concurrency int
+
+func (c concurrency) set(o *options) {
+	o.concurrency = int(c)
+}
+
+// WithSampleErrorPolicy defines how samples that could not be processed into records are handled.
+// Defaults to SendAndFail.
+func WithSampleErrorPolicy(p SampleErrorPolicy) Option {
+	return sampleErrorPolicy(p)
+}
+
+type sampleErrorPolicy SampleErrorPolicy
+
+func (p sampleErrorPolicy) set(o *options) {
+	o.sampleErrorPolicy = SampleErrorPolicy(p)
+}
+
+// WithSampleErrorThreshold fails a report without sending any records if more than the given percentage of samples could not be processed,
+// regardless of the sample error policy. A threshold of 0 disables the check.
+func WithSampleErrorThreshold(percent float64) Option {
+	return sampleErrorThreshold(percent)
+}
+
+type sampleErrorThreshold float64
+
+func (t sampleErrorThreshold) set(o *options) {
+	o.sampleErrorThreshold = float64(t)
+}
+
+// WithSampleErrorReporter allows setting a callback function.
+// The callback is called with the failed samples if the records of the valid samples are sent with the SendAndWarn policy.
+func WithSampleErrorReporter(r func(SampleErrors)) Option {
+	return sampleErrorReporter(r)
+}
+
+type sampleErrorReporter func(SampleErrors)
+
+func (r sampleErrorReporter) set(o *options) {
+	o.sampleErrorReporter = r
+}
+
+// WithMetrics allows recording the queries, processed samples and sent records in the given metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return metricsOption{m}
+}
+
+type metricsOption struct {
+	*metrics.Metrics
+}
+
+func (m metricsOption) set(o *options) {
+	o.metrics = m.Metrics
+}
+
 // Progress represent the progress when generating multiple reports.
+// It is reported after a report finished, in order of the timestamps.
 type Progress struct {
 	Timestamp time.Time
 	Count     int
+	// Attempts is the number of attempts the Prometheus query of the report took.
+	Attempts int
 }
 
 // WithProgressReporter allows setting a callback function.
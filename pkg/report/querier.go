@@ -0,0 +1,96 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+
+	"github.com/appuio/appuio-reporting/pkg/retry"
+)
+
+// RetryingQuerier is a PromQuerier that retries queries failing with a retryable error.
+// See IsRetryableQueryError for the errors that are retried.
+type RetryingQuerier struct {
+	Querier PromQuerier
+	Policy  retry.Policy
+	// Timeout is applied to each attempt if not zero.
+	Timeout time.Duration
+	// OnRetry is called before each retry if not nil.
+	OnRetry func(QueryRetry)
+}
+
+// QueryRetry describes a failed query attempt that is about to be retried.
+type QueryRetry struct {
+	Query     string
+	Timestamp time.Time
+	// Attempt is the number of the failed attempt, starting at 1.
+	Attempt int
+	Backoff time.Duration
+	Err     error
+}
+
+// Query implements PromQuerier.
+func (q RetryingQuerier) Query(ctx context.Context, query string, ts time.Time, opts ...apiv1.Option) (model.Value, apiv1.Warnings, error) {
+	for attempt := 1; ; attempt++ {
+		res, warnings, err := q.query(ctx, query, ts, opts...)
+		if err == nil {
+			return res, warnings, nil
+		}
+		if ctx.Err() != nil || !IsRetryableQueryError(err) {
+			return nil, warnings, err
+		}
+		if attempt > q.Policy.MaxRetries {
+			if attempt > 1 {
+				return nil, warnings, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return nil, warnings, err
+		}
+
+		backoff := q.Policy.Backoff(attempt)
+		if q.OnRetry != nil {
+			q.OnRetry(QueryRetry{
+				Query:     query,
+				Timestamp: ts,
+				Attempt:   attempt,
+				Backoff:   backoff,
+				Err:       err,
+			})
+		}
+		if err := retry.Sleep(ctx, backoff); err != nil {
+			return nil, warnings, fmt.Errorf("aborted retrying after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+func (q RetryingQuerier) query(ctx context.Context, query string, ts time.Time, opts ...apiv1.Option) (model.Value, apiv1.Warnings, error) {
+	if q.Timeout != 0 {
+		tctx, cancel := context.WithTimeout(ctx, q.Timeout)
+		defer cancel()
+		ctx = tctx
+	}
+	return q.Querier.Query(ctx, query, ts, opts...)
+}
+
+// rateLimitedMsg is the message of the client error the Prometheus API client returns for 429 Too Many Requests responses.
+var rateLimitedMsg = fmt.Sprintf("client error: %d", http.StatusTooManyRequests)
+
+// IsRetryableQueryError returns true if the error returned by a Prometheus query is likely to be transient.
+// These are server errors, timeouts, rate limiting and network errors.
+func IsRetryableQueryError(err error) bool {
+	var apiErr *apiv1.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Type == apiv1.ErrServer || apiErr.Type == apiv1.ErrTimeout ||
+			(apiErr.Type == apiv1.ErrClient && apiErr.Msg == rateLimitedMsg)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
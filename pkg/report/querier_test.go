@@ -0,0 +1,137 @@
+package report_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+	"github.com/appuio/appuio-reporting/pkg/retry"
+)
+
+func TestRetryingQuerier_RetriesRetryableErrors(t *testing.T) {
+	prom := &failingQuerier{errs: []error{
+		&apiv1.Error{Type: apiv1.ErrServer, Msg: "server error: 503"},
+		&apiv1.Error{Type: apiv1.ErrTimeout, Msg: "query timed out"},
+	}}
+	retries := make([]report.QueryRetry, 0)
+	uut := report.RetryingQuerier{
+		Querier: prom,
+		Policy:  retry.Policy{MaxRetries: 3, InitialBackoff: time.Millisecond},
+		OnRetry: func(r report.QueryRetry) { retries = append(retries, r) },
+	}
+
+	res, _, err := uut.Query(context.Background(), "up", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, model.Vector{}, res)
+	require.Equal(t, 3, prom.calls)
+	require.Len(t, retries, 2)
+	require.Equal(t, 1, retries[0].Attempt)
+	require.Equal(t, 2, retries[1].Attempt)
+	require.Equal(t, "up", retries[1].Query)
+}
+
+func TestRetryingQuerier_GivesUp(t *testing.T) {
+	prom := &failingQuerier{errs: []error{
+		&apiv1.Error{Type: apiv1.ErrServer},
+		&apiv1.Error{Type: apiv1.ErrServer},
+		&apiv1.Error{Type: apiv1.ErrServer},
+	}}
+	uut := report.RetryingQuerier{
+		Querier: prom,
+		Policy:  retry.Policy{MaxRetries: 1, InitialBackoff: time.Millisecond},
+	}
+
+	_, _, err := uut.Query(context.Background(), "up", time.Now())
+	require.ErrorContains(t, err, "giving up after 2 attempts")
+	require.Equal(t, 2, prom.calls)
+}
+
+func TestRetryingQuerier_DoesNotRetryBadQueries(t *testing.T) {
+	prom := &failingQuerier{errs: []error{
+		&apiv1.Error{Type: apiv1.ErrBadData, Msg: "parse error"},
+	}}
+	uut := report.RetryingQuerier{
+		Querier: prom,
+		Policy:  retry.Policy{MaxRetries: 3, InitialBackoff: time.Millisecond},
+	}
+
+	_, _, err := uut.Query(context.Background(), "up{", time.Now())
+	require.Error(t, err)
+	require.Equal(t, 1, prom.calls)
+}
+
+func TestRetryingQuerier_RetriesRateLimiting(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "too many outstanding requests", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(api.Config{Address: srv.URL})
+	require.NoError(t, err)
+
+	uut := report.RetryingQuerier{
+		Querier: apiv1.NewAPI(client),
+		Policy:  retry.Policy{MaxRetries: 1, InitialBackoff: time.Millisecond},
+	}
+
+	_, _, err = uut.Query(context.Background(), "up", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+}
+
+func TestReport_RunRange_ReportsAttempts(t *testing.T) {
+	prom := &failingQuerier{errs: []error{&apiv1.Error{Type: apiv1.ErrServer}}}
+	args := getReportArgs()
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	progress := make([]report.Progress, 0)
+	_, err := report.RunRange(context.Background(), &MockOdooClient{}, prom, args, base, base.Add(2*time.Hour),
+		report.WithPrometheusQueryRetry(retry.Policy{MaxRetries: 1, InitialBackoff: time.Millisecond}),
+		report.WithProgressReporter(func(p report.Progress) { progress = append(progress, p) }),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []report.Progress{
+		{Timestamp: base, Count: 1, Attempts: 2},
+		{Timestamp: base.Add(time.Hour), Count: 2, Attempts: 1},
+	}, progress)
+}
+
+func TestIsRetryableQueryError(t *testing.T) {
+	require.True(t, report.IsRetryableQueryError(&apiv1.Error{Type: apiv1.ErrServer}))
+	require.True(t, report.IsRetryableQueryError(&apiv1.Error{Type: apiv1.ErrTimeout}))
+	require.True(t, report.IsRetryableQueryError(context.DeadlineExceeded))
+	require.False(t, report.IsRetryableQueryError(&apiv1.Error{Type: apiv1.ErrBadData}))
+	require.False(t, report.IsRetryableQueryError(&apiv1.Error{Type: apiv1.ErrClient}))
+	require.False(t, report.IsRetryableQueryError(&apiv1.Error{Type: apiv1.ErrClient, Msg: "client error: 404"}))
+	require.False(t, report.IsRetryableQueryError(errors.New("unknown")))
+}
+
+// failingQuerier returns the given errors in order and an empty vector afterwards.
+type failingQuerier struct {
+	errs  []error
+	calls int
+}
+
+func (q *failingQuerier) Query(ctx context.Context, query string, ts time.Time, opts ...apiv1.Option) (model.Value, apiv1.Warnings, error) {
+	q.calls++
+	if q.calls <= len(q.errs) {
+		return nil, nil, q.errs[q.calls-1]
+	}
+	return model.Vector{}, nil, nil
+}
@@ -3,9 +3,14 @@ package report
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/appuio/appuio-reporting/pkg/metrics"
 	"github.com/appuio/appuio-reporting/pkg/odoo"
 	"github.com/google/go-jsonnet"
 	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
@@ -21,6 +26,14 @@ type OdooClient interface {
 	SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error
 }
 
+// Ledger keeps track of delivered records, so that re-running a report does not deliver them twice. See LedgerClient.
+type Ledger interface {
+	// Delivered returns true if the record has been delivered before.
+	Delivered(odoo.OdooMeteredBillingRecord) bool
+	// Record marks the records as delivered.
+	Record([]odoo.OdooMeteredBillingRecord) error
+}
+
 type ReportArgs struct {
 	Query                       string
 	InstanceJsonnet             string
@@ -29,28 +42,197 @@ type ReportArgs struct {
 	UnitID                      string
 	ProductID                   string
 	TimerangeSize               time.Duration
-	OverrideSalesOrderID        string
+	// ProductIDJsonnet computes the product ID from the labels of a sample. Takes precedence over ProductID.
+	ProductIDJsonnet string
+	// UnitIDJsonnet computes the unit ID from the labels of a sample. Takes precedence over UnitID.
+	UnitIDJsonnet string
+	// SalesOrderLabels are the labels the sales order ID is taken from, tried in order.
+	// Defaults to SalesOrderLabel.
+	SalesOrderLabels []string
+	// SalesOrderJsonnet computes the sales order ID from the labels of a sample. Takes precedence over SalesOrderLabels.
+	SalesOrderJsonnet string
+	// JsonnetLibraryPaths are the directories searched for files imported by the Jsonnet snippets.
+	JsonnetLibraryPaths []string
+	// JsonnetExtVars are additional string external variables available to the Jsonnet snippets.
+	JsonnetExtVars map[string]string
+	// Alignment defines where the timeranges start. Defaults to AlignAuto.
+	Alignment Alignment
+	// Location is the timezone of day and month boundaries. Defaults to UTC.
+	Location *time.Location
 }
 
+// SalesOrderLabel is the label the sales order ID is taken from by default.
 const SalesOrderLabel = "sales_order"
 
+// RangeSummary summarizes the results of a report range.
+type RangeSummary struct {
+	Succeeded []time.Time
+	Failed    []RangeFailure
+	// Skipped contains the timestamps that were not run because of an earlier error or a cancelled context.
+	Skipped []time.Time
+}
+
+// RangeFailure is a failed report of a report range.
+type RangeFailure struct {
+	Timestamp time.Time
+	Err       error
+}
+
+// Count returns the number of reports run, including failed ones.
+func (s RangeSummary) Count() int {
+	return len(s.Succeeded) + len(s.Failed)
+}
+
 // RunRange executes prometheus queries like Run() until the `until` timestamp is reached or an error occurred.
+// If a checkpoint file is configured, the checkpoint is updated after each successful report.
 // Returns the number of reports run and a possible error.
 func RunRange(ctx context.Context, odoo OdooClient, prom PromQuerier, args ReportArgs, from time.Time, until time.Time, options ...Option) (int, error) {
+	s, err := RunRangeWithSummary(ctx, odoo, prom, args, from, until, options...)
+	return s.Count(), err
+}
+
+// RunRangeWithSummary executes prometheus queries like RunRange() and returns a summary of the succeeded, failed and skipped reports.
+// By default, it stops at the first error. With WithContinueOnError() all reports are run and an error is returned if any of them failed.
+// With WithConcurrency() multiple reports are run in parallel. Progress is still reported in order of the timestamps, after the reports finished.
+// The checkpoint is only advanced while all earlier reports succeeded.
+func RunRangeWithSummary(ctx context.Context, odoo OdooClient, prom PromQuerier, args ReportArgs, from time.Time, until time.Time, options ...Option) (RangeSummary, error) {
 	opts := buildOptions(options)
+	if err := args.CheckTimerange(); err != nil {
+		return RangeSummary{}, err
+	}
+
+	timestamps := make([]time.Time, 0)
+	for currentTime := from; until.After(currentTime); currentTime = args.TimerangeEnd(currentTime) {
+		timestamps = append(timestamps, currentTime)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	n := 0
-	for currentTime := from; until.After(currentTime); currentTime = currentTime.Add(args.TimerangeSize) {
-		n++
-		if opts.progressReporter != nil {
-			opts.progressReporter(Progress{currentTime, n})
+	workers := opts.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		index    int
+		attempts int
+		err      error
+	}
+	jobs := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// Count the query attempts for the progress report, while still notifying the configured retry reporter.
+				attempts := 1
+				countAttempts := WithQueryRetryReporter(func(r QueryRetry) {
+					attempts = r.Attempt + 1
+					if opts.queryRetryReporter != nil {
+						opts.queryRetryReporter(r)
+					}
+				})
+				err := Run(runCtx, odoo, prom, args, timestamps[i], append(slices.Clip(options), countAttempts)...)
+				results <- result{i, attempts, err}
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	const (
+		pending = iota
+		succeeded
+		failed
+		skipped
+	)
+	status := make([]int, len(timestamps))
+	errs := make([]error, len(timestamps))
+	attempts := make([]int, len(timestamps))
+
+	var fatalErr, checkpointErr error
+	dispatched, inFlight, finalized, reported := 0, 0, 0, 0
+	for {
+		var next chan<- int
+		if fatalErr == nil && runCtx.Err() == nil && dispatched < len(timestamps) {
+			next = jobs
 		}
-		if err := Run(ctx, odoo, prom, args, currentTime, options...); err != nil {
-			return n, fmt.Errorf("error running report at %s: %w", currentTime.Format(time.RFC3339), err)
+		if next == nil && inFlight == 0 {
+			break
+		}
+
+		select {
+		case next <- dispatched:
+			inFlight++
+			dispatched++
+		case r := <-results:
+			inFlight--
+			attempts[r.index] = r.attempts
+			switch {
+			case r.err == nil:
+				status[r.index] = succeeded
+			case runCtx.Err() != nil && errors.Is(r.err, context.Canceled):
+				// The report was aborted because of another error or a cancelled parent context.
+				status[r.index] = skipped
+			default:
+				status[r.index] = failed
+				errs[r.index] = fmt.Errorf("error running report at %s: %w", timestamps[r.index].Format(time.RFC3339), r.err)
+				if !opts.continueOnError && fatalErr == nil {
+					fatalErr = errs[r.index]
+					cancel()
+				}
+			}
+
+			// Report the progress of finished reports in order of the timestamps.
+			for ; reported < dispatched && status[reported] != pending; reported++ {
+				if opts.progressReporter != nil && status[reported] != skipped {
+					opts.progressReporter(Progress{Timestamp: timestamps[reported], Count: reported + 1, Attempts: attempts[reported]})
+				}
+			}
+
+			// Advance the checkpoint as long as all reports up to the current one succeeded.
+			for ; finalized < dispatched && status[finalized] == succeeded; finalized++ {
+				// Reports finishing after a later report failed are still recorded, so that they are not sent again on resume.
+				if opts.checkpointFile == "" || checkpointErr != nil {
+					continue
+				}
+				if err := WriteCheckpoint(opts.checkpointFile, Checkpoint{ProductID: args.ProductID, LastDelivered: timestamps[finalized].In(time.UTC)}); err != nil {
+					checkpointErr = err
+					if fatalErr == nil {
+						fatalErr = err
+					}
+					cancel()
+				}
+			}
+		}
+	}
+
+	var s RangeSummary
+	for i, t := range timestamps {
+		switch status[i] {
+		case succeeded:
+			s.Succeeded = append(s.Succeeded, t)
+		case failed:
+			s.Failed = append(s.Failed, RangeFailure{Timestamp: t, Err: errs[i]})
+		default:
+			s.Skipped = append(s.Skipped, t)
 		}
 	}
 
-	return n, nil
+	if fatalErr != nil {
+		return s, fatalErr
+	}
+	if len(s.Failed) > 0 {
+		return s, fmt.Errorf("%d of %d reports failed, first failure: %w", len(s.Failed), s.Count(), s.Failed[0].Err)
+	}
+	if len(s.Skipped) > 0 {
+		return s, ctx.Err()
+	}
+	return s, nil
 }
 
 // Run executes a prometheus query loaded from queries with using the `queryName` and the timestamp.
@@ -59,8 +241,8 @@ func Run(ctx context.Context, odoo OdooClient, prom PromQuerier, args ReportArgs
 	opts := buildOptions(options)
 
 	from = from.In(time.UTC)
-	if !from.Truncate(time.Hour).Equal(from) {
-		return fmt.Errorf("timestamp should only contain full hours based on UTC, got: %s", from.Format(time.RFC3339Nano))
+	if err := args.CheckAlignment(from); err != nil {
+		return err
 	}
 
 	if err := runQuery(ctx, odoo, prom, args, from, opts); err != nil {
@@ -70,64 +252,189 @@ func Run(ctx context.Context, odoo OdooClient, prom PromQuerier, args ReportArgs
 	return nil
 }
 
-func runQuery(ctx context.Context, odooClient OdooClient, prom PromQuerier, args ReportArgs, from time.Time, opts options) error {
-	promQCtx := ctx
-	if opts.prometheusQueryTimeout != 0 {
-		ctx, cancel := context.WithTimeout(promQCtx, opts.prometheusQueryTimeout)
-		defer cancel()
-		promQCtx = ctx
+// Records runs the query at the given timestamp and processes the returned samples into records, without sending them.
+// Records of samples that could be processed are returned even if processing other samples failed.
+// The failures are returned combined in the error.
+func Records(ctx context.Context, prom PromQuerier, args ReportArgs, from time.Time, options ...Option) ([]odoo.OdooMeteredBillingRecord, error) {
+	opts := buildOptions(options)
+
+	from = from.In(time.UTC)
+	if err := args.CheckAlignment(from); err != nil {
+		return nil, err
+	}
+
+	records, sampleErrs, err := queryRecords(ctx, prom, args, from, opts)
+	if err != nil {
+		return nil, err
+	}
+	return records, sampleErrs
+}
+
+// queryRecords runs the query and processes the returned samples into records.
+// The returned error is set if the query failed, sampleErrs contains the errors of samples that could not be processed.
+func queryRecords(ctx context.Context, prom PromQuerier, args ReportArgs, from time.Time, opts options) (records []odoo.OdooMeteredBillingRecord, sampleErrs error, err error) {
+	querier := RetryingQuerier{
+		Querier: prom,
+		Policy:  opts.queryRetryPolicy,
+		Timeout: opts.prometheusQueryTimeout,
+		OnRetry: opts.queryRetryReporter,
 	}
 
 	// The data in the database is from T to T+1h. Prometheus queries backwards from T to T-1h.
-	res, _, err := prom.Query(promQCtx, args.Query, from.Add(args.TimerangeSize))
+	start := time.Now()
+	res, _, err := querier.Query(ctx, args.Query, args.TimerangeEnd(from))
 	if err != nil {
-		return fmt.Errorf("failed to query prometheus: %w", err)
+		return nil, nil, fmt.Errorf("failed to query prometheus: %w", err)
 	}
 
 	samples, ok := res.(model.Vector)
 	if !ok {
-		return fmt.Errorf("expected prometheus query to return a model.Vector, got %T", res)
+		return nil, nil, fmt.Errorf("expected prometheus query to return a model.Vector, got %T", res)
 	}
+	opts.metrics.ObserveQuery(args.ProductID, time.Since(start), len(samples))
 
-	if samples.Len() == 0 {
-		return nil
-	}
-
-	var errs error
-	records := make([]odoo.OdooMeteredBillingRecord, 0, len(samples))
+	// The importer is shared by the samples of this query, so that imported files are only read once.
+	importer := newJsonnetImporter(args)
+	records = make([]odoo.OdooMeteredBillingRecord, 0, len(samples))
 	for _, sample := range samples {
-		record, err := processSample(ctx, odooClient, args, from, sample)
+		record, err := processSample(ctx, args, importer, from, sample)
 		if err != nil {
-			errs = multierr.Append(errs, fmt.Errorf("failed to process sample: %w", err))
+			sampleErrs = multierr.Append(sampleErrs, fmt.Errorf("failed to process sample: %w", err))
+			opts.metrics.AddSampleFailures(sampleProductID(args, importer, from, sample), 1)
 		} else {
 			records = append(records, *record)
 		}
 	}
+	return records, sampleErrs, nil
+}
 
-	return multierr.Append(errs, odooClient.SendData(ctx, records))
+// sampleProductID returns the product ID of a sample that could not be processed, so that the failure is attributed to the product in the metrics.
+// It is empty if the product ID is computed per sample and could not be evaluated.
+func sampleProductID(args ReportArgs, importer jsonnet.Importer, from time.Time, s *model.Sample) string {
+	if args.ProductIDJsonnet == "" {
+		return args.ProductID
+	}
+	vm, err := newJsonnetVM(args, importer, from, s)
+	if err != nil {
+		return ""
+	}
+	productID, err := evaluateID(vm, "product_id.json", "product ID", args.ProductIDJsonnet)
+	if err != nil {
+		return ""
+	}
+	return productID
 }
 
-func processSample(ctx context.Context, odooClient OdooClient, args ReportArgs, from time.Time, s *model.Sample) (*odoo.OdooMeteredBillingRecord, error) {
-	metricLabels := s.Metric
+func runQuery(ctx context.Context, odooClient OdooClient, prom PromQuerier, args ReportArgs, from time.Time, opts options) (err error) {
+	records, sampleErrs, err := queryRecords(ctx, prom, args, from, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			observeSuccess(opts.metrics, args, from, records)
+		}
+	}()
+	if len(records) == 0 && sampleErrs == nil {
+		return nil
+	}
 
-	salesOrderID := ""
-	if args.OverrideSalesOrderID != "" {
-		salesOrderID = args.OverrideSalesOrderID
-	} else {
-		sid, err := getMetricLabel(s.Metric, SalesOrderLabel)
-		if err != nil {
-			return nil, err
+	failed := len(multierr.Errors(sampleErrs))
+	send, errs := handleSampleErrors(SampleErrors{
+		Timestamp: from,
+		Failed:    failed,
+		Total:     len(records) + failed,
+		Err:       sampleErrs,
+	}, opts)
+	if !send {
+		return errs
+	}
+
+	err = sendRecords(ctx, odooClient, records)
+	observeRecordsSent(opts.metrics, records, err)
+	return multierr.Append(errs, err)
+}
+
+// observeRecordsSent records the number of delivered records per product.
+// If sending failed, only the chunks before the failed one were delivered.
+func observeRecordsSent(m *metrics.Metrics, records []odoo.OdooMeteredBillingRecord, sendErr error) {
+	if sendErr != nil {
+		var chunkErr *odoo.ChunkError
+		if !errors.As(sendErr, &chunkErr) {
+			return
+		}
+		records = records[:chunkErr.Offset]
+	}
+	counts := make(map[string]int)
+	for _, r := range records {
+		counts[r.ProductID]++
+	}
+	for product, n := range counts {
+		m.AddRecordsSent(product, n)
+	}
+}
+
+// observeSuccess records the successfully reported timerange for the products of the records.
+// The product ID of the report is used if there are no records.
+func observeSuccess(m *metrics.Metrics, args ReportArgs, from time.Time, records []odoo.OdooMeteredBillingRecord) {
+	products := make(map[string]struct{})
+	for _, r := range records {
+		products[r.ProductID] = struct{}{}
+	}
+	if len(products) == 0 && args.ProductID != "" {
+		products[args.ProductID] = struct{}{}
+	}
+	for product := range products {
+		m.SetLastSuccess(product, from)
+	}
+}
+
+// sendRecords sends the records and attaches the instance ID and sales order of records rejected by the Odoo API to the error.
+func sendRecords(ctx context.Context, odooClient OdooClient, records []odoo.OdooMeteredBillingRecord) error {
+	err := odooClient.SendData(ctx, records)
+	var apiErr *odoo.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	for _, re := range apiErr.RecordErrors {
+		if re.Index < 0 || re.Index >= len(records) {
+			continue
 		}
-		salesOrderID = string(sid)
+		r := records[re.Index]
+		err = multierr.Append(err, fmt.Errorf("record with instance ID '%s' and sales order '%s' rejected: %w", r.InstanceID, r.SalesOrderID, re))
+	}
+	return err
+}
+
+func processSample(ctx context.Context, args ReportArgs, importer jsonnet.Importer, from time.Time, s *model.Sample) (*odoo.OdooMeteredBillingRecord, error) {
+	metricLabels := s.Metric
+
+	vm, err := newJsonnetVM(args, importer, from, s)
+	if err != nil {
+		return nil, err
 	}
 
-	labelList, err := json.Marshal(metricLabels)
+	salesOrderID, err := getSalesOrderID(vm, args, metricLabels)
 	if err != nil {
 		return nil, err
 	}
 
-	vm := jsonnet.MakeVM()
-	vm.ExtCode("labels", string(labelList))
+	productID := args.ProductID
+	if args.ProductIDJsonnet != "" {
+		productID, err = evaluateID(vm, "product_id.json", "product ID", args.ProductIDJsonnet)
+		if err != nil {
+			return nil, err
+		}
+		vm.ExtVar(ExtVarProductID, productID)
+	}
+	unitID := args.UnitID
+	if args.UnitIDJsonnet != "" {
+		unitID, err = evaluateID(vm, "unit_id.json", "unit ID", args.UnitIDJsonnet)
+		if err != nil {
+			return nil, err
+		}
+		vm.ExtVar(ExtVarUnitID, unitID)
+	}
 
 	instance, err := vm.EvaluateAnonymousSnippet("instance.json", args.InstanceJsonnet)
 	if err != nil {
@@ -165,16 +472,16 @@ func processSample(ctx context.Context, odooClient OdooClient, args ReportArgs,
 
 	timerange := odoo.Timerange{
 		From: from,
-		To:   from.Add(args.TimerangeSize),
+		To:   args.TimerangeEnd(from),
 	}
 
 	record := odoo.OdooMeteredBillingRecord{
-		ProductID:            args.ProductID,
+		ProductID:            productID,
 		InstanceID:           instanceStr,
 		ItemDescription:      descriptionStr,
 		ItemGroupDescription: groupStr,
 		SalesOrderID:         salesOrderID,
-		UnitID:               args.UnitID,
+		UnitID:               unitID,
 		ConsumedUnits:        float64(s.Value),
 		Timerange:            timerange,
 	}
@@ -182,6 +489,52 @@ func processSample(ctx context.Context, odooClient OdooClient, args ReportArgs,
 	return &record, nil
 }
 
+// getSalesOrderID returns the sales order ID of a sample.
+// It is computed by the sales order Jsonnet if set, otherwise it is taken from the first of the sales order labels the sample contains.
+func getSalesOrderID(vm *jsonnet.VM, args ReportArgs, m model.Metric) (string, error) {
+	if args.SalesOrderJsonnet == "" {
+		sid, err := getFirstMetricLabel(m, args.salesOrderLabels())
+		return string(sid), err
+	}
+	return evaluateID(vm, "sales_order.json", "sales order", args.SalesOrderJsonnet)
+}
+
+// evaluateID evaluates a Jsonnet snippet computing an ID. The snippet has to evaluate to a non-empty string.
+func evaluateID(vm *jsonnet.VM, filename, name, snippet string) (string, error) {
+	out, err := vm.EvaluateAnonymousSnippet(filename, snippet)
+	if err != nil {
+		return "", fmt.Errorf("failed to interpolate %s template: %w", name, err)
+	}
+	var id string
+	if err := json.Unmarshal([]byte(out), &id); err != nil {
+		return "", fmt.Errorf("failed to interpolate %s template: %w", name, err)
+	}
+	if id == "" {
+		return "", fmt.Errorf("%s template evaluated to an empty string", name)
+	}
+	return id, nil
+}
+
+func (args ReportArgs) salesOrderLabels() []string {
+	if len(args.SalesOrderLabels) == 0 {
+		return []string{SalesOrderLabel}
+	}
+	return args.SalesOrderLabels
+}
+
+// getFirstMetricLabel returns the value of the first of the given labels the metric contains.
+func getFirstMetricLabel(m model.Metric, names []string) (model.LabelValue, error) {
+	if len(names) == 1 {
+		return getMetricLabel(m, names[0])
+	}
+	for _, name := range names {
+		if value, ok := m[model.LabelName(name)]; ok {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("expected sample to contain one of the labels '%s'", strings.Join(names, "', '"))
+}
+
 func getMetricLabel(m model.Metric, name string) (model.LabelValue, error) {
 	value, ok := m[model.LabelName(name)]
 	if !ok {
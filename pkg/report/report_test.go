@@ -2,10 +2,16 @@ package report_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 
@@ -73,9 +79,9 @@ func (s *ReportSuite) TestReport_RunRange() {
 	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
 
 	expectedProgress := []report.Progress{
-		{base.Add(0 * time.Hour), 1},
-		{base.Add(1 * time.Hour), 2},
-		{base.Add(2 * time.Hour), 3},
+		{Timestamp: base.Add(0 * time.Hour), Count: 1, Attempts: 1},
+		{Timestamp: base.Add(1 * time.Hour), Count: 2, Attempts: 1},
+		{Timestamp: base.Add(2 * time.Hour), Count: 3, Attempts: 1},
 	}
 
 	progress := make([]report.Progress, 0)
@@ -150,12 +156,12 @@ func (s *ReportSuite) TestReport_RequireErrorWhenNoSalesOrder() {
 	require.Error(t, err)
 }
 
-func (s *ReportSuite) TestReport_OverrideSalesOrderID() {
+func (s *ReportSuite) TestReport_SalesOrderJsonnet() {
 	t := s.T()
 	o := &MockOdooClient{}
 	prom := s.PrometheusAPIClient()
 	args := getReportArgs()
-	args.OverrideSalesOrderID = "myoverride"
+	args.SalesOrderJsonnet = `"myoverride"`
 
 	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
 
@@ -186,3 +192,395 @@ func (c *MockOdooClient) SendData(ctx context.Context, data []odoo.OdooMeteredBi
 	c.totalReceived += 1
 	return nil
 }
+
+func TestReport_SkipsRecordsDeliveredAccordingToLedger(t *testing.T) {
+	o := &MockOdooClient{}
+	l := &MockLedger{}
+	prom := staticQuerier{
+		sample("SO00000", "instance-a", 1),
+		sample("SO00000", "instance-b", 2),
+	}
+	args := getReportArgs()
+	args.InstanceJsonnet = `local labels = std.extVar("labels"); labels.instance`
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.NoError(t, report.Run(context.Background(), report.LedgerClient{Client: o, Ledger: l}, prom, args, from))
+	require.Equal(t, 1, o.totalReceived)
+	require.Len(t, o.lastReceivedData, 2)
+	require.Len(t, l.delivered, 2)
+
+	require.NoError(t, report.Run(context.Background(), report.LedgerClient{Client: o, Ledger: l}, prom, args, from))
+	require.Equal(t, 1, o.totalReceived, "no records should be sent if all have been delivered")
+
+	l.delivered = l.delivered[:1]
+	require.NoError(t, report.Run(context.Background(), report.LedgerClient{Client: o, Ledger: l}, prom, args, from))
+	require.Equal(t, 2, o.totalReceived)
+	require.Len(t, o.lastReceivedData, 1)
+	require.Equal(t, "instance-b", o.lastReceivedData[0].InstanceID)
+}
+
+func TestReport_DoesNotRecordFailedDeliveries(t *testing.T) {
+	l := &MockLedger{}
+	prom := staticQuerier{sample("SO00000", "instance-a", 1)}
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.Error(t, report.Run(context.Background(), report.LedgerClient{Client: &FailingOdooClient{}, Ledger: l}, prom, getReportArgs(), from))
+	require.Empty(t, l.delivered)
+}
+
+// staticQuerier returns the same samples for every query.
+type staticQuerier model.Vector
+
+func (q staticQuerier) Query(ctx context.Context, query string, ts time.Time, opts ...apiv1.Option) (model.Value, apiv1.Warnings, error) {
+	return model.Vector(q), nil, nil
+}
+
+func sample(salesOrder, instance string, value float64) *model.Sample {
+	return &model.Sample{
+		Metric: model.Metric{
+			"sales_order": model.LabelValue(salesOrder),
+			"instance":    model.LabelValue(instance),
+		},
+		Value: model.SampleValue(value),
+	}
+}
+
+type FailingOdooClient struct{}
+
+func (c *FailingOdooClient) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	return errors.New("odoo is down")
+}
+
+type MockLedger struct {
+	delivered []odoo.OdooMeteredBillingRecord
+}
+
+func (l *MockLedger) Delivered(r odoo.OdooMeteredBillingRecord) bool {
+	for _, d := range l.delivered {
+		if d.InstanceID == r.InstanceID && d.SalesOrderID == r.SalesOrderID && d.Timerange == r.Timerange {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *MockLedger) Record(records []odoo.OdooMeteredBillingRecord) error {
+	l.delivered = append(l.delivered, records...)
+	return nil
+}
+
+func TestReport_RunRangeWithSummary_StopsAtFirstError(t *testing.T) {
+	prom := staticQuerier{sample("SO00000", "instance-a", 1)}
+	o := &OdooClientFailingAt{failing: map[int]bool{2: true}}
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	s, err := report.RunRangeWithSummary(context.Background(), o, prom, getReportArgs(), base, base.Add(4*time.Hour))
+	require.ErrorContains(t, err, "error running report at 2020-01-23T18:00:00Z")
+	require.Equal(t, []time.Time{base}, s.Succeeded)
+	require.Len(t, s.Failed, 1)
+	require.Equal(t, base.Add(time.Hour), s.Failed[0].Timestamp)
+	require.Equal(t, []time.Time{base.Add(2 * time.Hour), base.Add(3 * time.Hour)}, s.Skipped)
+	require.Equal(t, 2, s.Count())
+}
+
+func TestReport_RunRangeWithSummary_ContinueOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	prom := staticQuerier{sample("SO00000", "instance-a", 1)}
+	o := &OdooClientFailingAt{failing: map[int]bool{2: true, 4: true}}
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	s, err := report.RunRangeWithSummary(context.Background(), o, prom, getReportArgs(), base, base.Add(5*time.Hour),
+		report.WithContinueOnError(),
+		report.WithCheckpointFile(path),
+	)
+	require.ErrorContains(t, err, "2 of 5 reports failed")
+	require.Equal(t, []time.Time{base, base.Add(2 * time.Hour), base.Add(4 * time.Hour)}, s.Succeeded)
+	require.Len(t, s.Failed, 2)
+	require.Equal(t, base.Add(time.Hour), s.Failed[0].Timestamp)
+	require.Equal(t, base.Add(3*time.Hour), s.Failed[1].Timestamp)
+	require.Empty(t, s.Skipped)
+
+	c, _, err := report.ReadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, base, c.LastDelivered, "checkpoint should not advance past the first failure")
+}
+
+func TestReport_RunRangeWithSummary_SkipsAfterCancel(t *testing.T) {
+	prom := staticQuerier{sample("SO00000", "instance-a", 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	s, err := report.RunRangeWithSummary(ctx, &MockOdooClient{}, prom, getReportArgs(), base, base.Add(3*time.Hour),
+		report.WithContinueOnError(),
+		report.WithProgressReporter(func(p report.Progress) {
+			if p.Count == 2 {
+				cancel()
+			}
+		}),
+	)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, []time.Time{base, base.Add(time.Hour)}, s.Succeeded)
+	require.Equal(t, []time.Time{base.Add(2 * time.Hour)}, s.Skipped)
+}
+
+// OdooClientFailingAt fails the calls with the given numbers, starting at 1.
+type OdooClientFailingAt struct {
+	failing map[int]bool
+	calls   int
+}
+
+func (c *OdooClientFailingAt) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	c.calls++
+	if c.failing[c.calls] {
+		return errors.New("odoo is down")
+	}
+	return nil
+}
+
+func TestReport_RunRangeWithConcurrency(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	prom := slowQuerier{sample("SO00000", "instance-a", 1)}
+	o := &ConcurrentMockOdooClient{}
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	progress := make([]report.Progress, 0)
+	s, err := report.RunRangeWithSummary(context.Background(), o, prom, getReportArgs(), base, base.Add(10*time.Hour),
+		report.WithConcurrency(4),
+		report.WithCheckpointFile(path),
+		report.WithProgressReporter(func(p report.Progress) { progress = append(progress, p) }),
+	)
+	require.NoError(t, err)
+	require.Len(t, s.Succeeded, 10)
+	require.Len(t, o.received, 10)
+	for i, p := range progress {
+		require.Equal(t, report.Progress{Timestamp: base.Add(time.Duration(i) * time.Hour), Count: i + 1, Attempts: 1}, p)
+	}
+
+	c, _, err := report.ReadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, base.Add(9*time.Hour), c.LastDelivered)
+}
+
+func TestReport_RunRangeWithConcurrency_CancelsOnError(t *testing.T) {
+	prom := slowQuerier{sample("SO00000", "instance-a", 1)}
+	base := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+	o := &ConcurrentMockOdooClient{failAt: base.Add(3 * time.Hour)}
+
+	s, err := report.RunRangeWithSummary(context.Background(), o, prom, getReportArgs(), base, base.Add(100*time.Hour),
+		report.WithConcurrency(4),
+	)
+	require.ErrorContains(t, err, "error running report at 2020-01-23T20:00:00Z")
+	require.Len(t, s.Failed, 1)
+	require.NotEmpty(t, s.Skipped)
+	require.Equal(t, 100, len(s.Succeeded)+len(s.Failed)+len(s.Skipped))
+}
+
+// slowQuerier returns the same samples for every query after a short delay.
+type slowQuerier model.Vector
+
+func (q slowQuerier) Query(ctx context.Context, query string, ts time.Time, opts ...apiv1.Option) (model.Value, apiv1.Warnings, error) {
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-time.After(time.Duration(ts.Hour()%3) * time.Millisecond):
+	}
+	return model.Vector(q), nil, nil
+}
+
+// ConcurrentMockOdooClient is safe for concurrent use and fails for records starting at failAt.
+type ConcurrentMockOdooClient struct {
+	failAt time.Time
+
+	mu       sync.Mutex
+	received [][]odoo.OdooMeteredBillingRecord
+}
+
+func (c *ConcurrentMockOdooClient) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(data) > 0 && data[0].Timerange.From.Equal(c.failAt) {
+		return errors.New("odoo is down")
+	}
+	c.received = append(c.received, data)
+	return nil
+}
+
+func TestReport_RecordsDeliveredChunksInLedger(t *testing.T) {
+	l := &MockLedger{}
+	prom := staticQuerier{
+		sample("SO00000", "instance-a", 1),
+		sample("SO00000", "instance-b", 2),
+	}
+	args := getReportArgs()
+	args.InstanceJsonnet = `local labels = std.extVar("labels"); labels.instance`
+	o := &ChunkFailingOdooClient{}
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.Error(t, report.Run(context.Background(), report.LedgerClient{Client: o, Ledger: l}, prom, args, from))
+	require.Len(t, l.delivered, 1)
+	require.Equal(t, "instance-a", l.delivered[0].InstanceID)
+}
+
+func TestLedgerClient_MapsErrorsToGivenRecords(t *testing.T) {
+	records := []odoo.OdooMeteredBillingRecord{{InstanceID: "instance-a"}, {InstanceID: "instance-b"}, {InstanceID: "instance-c"}}
+	l := &MockLedger{delivered: records[:1]}
+
+	err := report.LedgerClient{Client: &ChunkFailingOdooClient{}, Ledger: l}.SendData(context.Background(), records)
+	var chunkErr *odoo.ChunkError
+	require.ErrorAs(t, err, &chunkErr)
+	require.Equal(t, 2, chunkErr.Offset, "the offset should include the records skipped because they were delivered before")
+	require.Len(t, l.delivered, 2)
+	require.Equal(t, "instance-b", l.delivered[1].InstanceID)
+
+	rejecting := &RejectingOdooClient{errs: []odoo.RecordError{{Index: 0, Message: "unknown sales order"}}}
+	err = report.LedgerClient{Client: rejecting, Ledger: &MockLedger{delivered: records[:1]}}.SendData(context.Background(), records)
+	var apiErr *odoo.APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, 1, apiErr.RecordErrors[0].Index)
+}
+
+// ChunkFailingOdooClient delivers the first record and fails for the remaining ones.
+type ChunkFailingOdooClient struct{}
+
+func (c *ChunkFailingOdooClient) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	return &odoo.ChunkError{Chunk: 2, Chunks: 2, Offset: 1, Count: len(data) - 1, Err: errors.New("odoo is down")}
+}
+
+func TestReport_AttachesRejectedRecordsToError(t *testing.T) {
+	prom := staticQuerier{
+		sample("SO00000", "instance-a", 1),
+		sample("SO00001", "instance-b", 2),
+	}
+	args := getReportArgs()
+	args.InstanceJsonnet = `local labels = std.extVar("labels"); labels.instance`
+	o := &RejectingOdooClient{errs: []odoo.RecordError{{Index: 1, Field: "sales_order_id", Message: "unknown sales order"}}}
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	err := report.Run(context.Background(), o, prom, args, from)
+	require.ErrorContains(t, err, "record with instance ID 'instance-b' and sales order 'SO00001' rejected: sales_order_id: unknown sales order")
+
+	var apiErr *odoo.APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, 400, apiErr.StatusCode)
+}
+
+// RejectingOdooClient rejects all records with the given record errors.
+type RejectingOdooClient struct {
+	errs []odoo.RecordError
+}
+
+func (c *RejectingOdooClient) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	return &odoo.APIError{StatusCode: 400, Message: "invalid records", RecordErrors: c.errs}
+}
+
+func TestRecords_ReturnsRecordsWithoutSending(t *testing.T) {
+	prom := staticQuerier{sample("SO1", "a", 1), {Metric: model.Metric{"instance": "b"}, Value: 2}, sample("SO2", "c", 3)}
+	args := report.ReportArgs{
+		Query:           "usage",
+		InstanceJsonnet: `local labels = std.extVar("labels"); labels.instance`,
+		ProductID:       "my-product",
+		UnitID:          "my-unit",
+		TimerangeSize:   time.Hour,
+	}
+
+	records, err := report.Records(context.Background(), prom, args, time.Date(2023, 7, 8, 13, 0, 0, 0, time.UTC))
+	require.ErrorContains(t, err, "expected sample to contain label 'sales_order'")
+	require.Len(t, records, 2, "records of valid samples should be returned")
+	require.Equal(t, "a", records[0].InstanceID)
+	require.Equal(t, "SO2", records[1].SalesOrderID)
+
+	_, err = report.Records(context.Background(), prom, args, time.Date(2023, 7, 8, 13, 30, 0, 0, time.UTC))
+	require.ErrorContains(t, err, "full hours")
+}
+
+func TestReport_SalesOrderLabels(t *testing.T) {
+	o := &MockOdooClient{}
+	prom := staticQuerier{
+		{Metric: model.Metric{"billing_sales_order": "SO1", "sales_order": "SO2", "instance": "a"}, Value: 1},
+		{Metric: model.Metric{"sales_order": "SO3", "instance": "b"}, Value: 1},
+	}
+	args := getReportArgs()
+	args.SalesOrderLabels = []string{"billing_sales_order", "sales_order"}
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.NoError(t, report.Run(context.Background(), o, prom, args, from))
+	require.Equal(t, "SO1", o.lastReceivedData[0].SalesOrderID)
+	require.Equal(t, "SO3", o.lastReceivedData[1].SalesOrderID)
+
+	prom = staticQuerier{{Metric: model.Metric{"instance": "a"}, Value: 1}}
+	require.ErrorContains(t, report.Run(context.Background(), o, prom, args, from), "expected sample to contain one of the labels 'billing_sales_order', 'sales_order'")
+}
+
+func TestReport_SalesOrderJsonnet(t *testing.T) {
+	o := &MockOdooClient{}
+	prom := staticQuerier{
+		{Metric: model.Metric{"tenant_sales_order": "1234", "instance": "a"}, Value: 1},
+		{Metric: model.Metric{"instance": "b"}, Value: 1},
+	}
+	args := getReportArgs()
+	args.SalesOrderJsonnet = `local labels = std.extVar("labels"); "SO" + std.get(labels, "tenant_sales_order", "")`
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.NoError(t, report.Run(context.Background(), o, prom, args, from))
+	require.Equal(t, "SO1234", o.lastReceivedData[0].SalesOrderID)
+	require.Equal(t, "SO", o.lastReceivedData[1].SalesOrderID)
+
+	args.SalesOrderJsonnet = `local labels = std.extVar("labels"); std.get(labels, "tenant_sales_order", "")`
+	require.ErrorContains(t, report.Run(context.Background(), o, prom, args, from), "sales order template evaluated to an empty string")
+}
+
+func TestReport_ProductAndUnitIDJsonnet(t *testing.T) {
+	o := &MockOdooClient{}
+	prom := staticQuerier{
+		{Metric: model.Metric{"sales_order": "SO1", "storageclass": "ssd"}, Value: 1},
+		{Metric: model.Metric{"sales_order": "SO1", "storageclass": "bulk"}, Value: 2},
+	}
+	args := getReportArgs()
+	args.ProductID = ""
+	args.ProductIDJsonnet = `local labels = std.extVar("labels"); "storage-%s" % labels.storageclass`
+	args.UnitIDJsonnet = `local labels = std.extVar("labels"); if labels.storageclass == "ssd" then "unit_gb" else "unit_tb"`
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.NoError(t, report.Run(context.Background(), o, prom, args, from))
+	require.Equal(t, "storage-ssd", o.lastReceivedData[0].ProductID)
+	require.Equal(t, "unit_gb", o.lastReceivedData[0].UnitID)
+	require.Equal(t, "storage-bulk", o.lastReceivedData[1].ProductID)
+	require.Equal(t, "unit_tb", o.lastReceivedData[1].UnitID)
+
+	args.UnitIDJsonnet = `""`
+	require.ErrorContains(t, report.Run(context.Background(), o, prom, args, from), "unit ID template evaluated to an empty string")
+}
+
+func TestReport_JsonnetLibraryPaths(t *testing.T) {
+	lib := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(lib, "billing.libsonnet"), []byte(`{
+		instance(labels):: "%(cluster)s:%(namespace)s" % labels,
+	}`), 0o644))
+
+	o := &MockOdooClient{}
+	prom := staticQuerier{{Metric: model.Metric{"sales_order": "SO1", "cluster": "c1", "namespace": "ns"}, Value: 1}}
+	args := getReportArgs()
+	args.InstanceJsonnet = `local billing = import "billing.libsonnet"; billing.instance(std.extVar("labels"))`
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.ErrorContains(t, report.Run(context.Background(), o, prom, args, from), "billing.libsonnet")
+
+	args.JsonnetLibraryPaths = []string{lib}
+	require.NoError(t, report.Run(context.Background(), o, prom, args, from))
+	require.Equal(t, "c1:ns", o.lastReceivedData[0].InstanceID)
+}
+
+func TestReport_JsonnetExtVars(t *testing.T) {
+	o := &MockOdooClient{}
+	prom := staticQuerier{{Metric: model.Metric{"sales_order": "SO1", "storageclass": "ssd"}, Value: 1.5}}
+	args := getReportArgs()
+	args.ProductIDJsonnet = `"storage-" + std.extVar("labels").storageclass`
+	args.InstanceJsonnet = `"%s/%s" % [std.extVar("productId"), std.extVar("unitId")]`
+	args.ItemDescriptionJsonnet = `"%s: %s to %s (%g)" % [std.extVar("cluster"), std.extVar("from"), std.extVar("to"), std.extVar("value") * 2]`
+	args.JsonnetExtVars = map[string]string{"cluster": "c1"}
+	from := time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+
+	require.NoError(t, report.Run(context.Background(), o, prom, args, from))
+	require.Equal(t, "storage-ssd/unit_kg", o.lastReceivedData[0].InstanceID, "the computed product ID should be available")
+	require.Equal(t, "c1: 2020-01-23T17:00:00Z to 2020-01-23T18:00:00Z (3)", o.lastReceivedData[0].ItemDescription)
+}
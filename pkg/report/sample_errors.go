@@ -0,0 +1,73 @@
+package report
+
+import (
+	"fmt"
+	"time"
+)
+
+// SampleErrorPolicy defines how a report handles samples that could not be processed into records.
+type SampleErrorPolicy string
+
+const (
+	// SendAndFail sends the records of the valid samples and fails the report. This is the default.
+	SendAndFail SampleErrorPolicy = "send-and-fail"
+	// SendAndWarn sends the records of the valid samples and reports the failed samples as a warning.
+	// See WithSampleErrorReporter.
+	SendAndWarn SampleErrorPolicy = "send-and-warn"
+	// FailBeforeSend fails the report without sending any records.
+	FailBeforeSend SampleErrorPolicy = "fail-before-send"
+)
+
+// SampleErrorPolicies are all available sample error policies.
+var SampleErrorPolicies = []SampleErrorPolicy{SendAndFail, SendAndWarn, FailBeforeSend}
+
+// ParseSampleErrorPolicy parses the given sample error policy.
+func ParseSampleErrorPolicy(s string) (SampleErrorPolicy, error) {
+	for _, p := range SampleErrorPolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown sample error policy %q, expected one of %q", s, SampleErrorPolicies)
+}
+
+// SampleErrors describes the samples of a report that could not be processed into records.
+type SampleErrors struct {
+	Timestamp time.Time
+	// Failed is the number of samples that could not be processed.
+	Failed int
+	// Total is the number of samples returned by the query.
+	Total int
+	// Err contains the errors of the failed samples.
+	Err error
+}
+
+// FailedPercentage returns the percentage of samples that could not be processed.
+func (e SampleErrors) FailedPercentage() float64 {
+	if e.Total == 0 {
+		return 0
+	}
+	return float64(e.Failed) / float64(e.Total) * 100
+}
+
+// handleSampleErrors applies the sample error policy and threshold.
+// Returns whether the records should be sent, and the error the report should fail with.
+func handleSampleErrors(e SampleErrors, opts options) (send bool, err error) {
+	if e.Failed == 0 {
+		return true, nil
+	}
+	if opts.sampleErrorThreshold > 0 && e.FailedPercentage() > opts.sampleErrorThreshold {
+		return false, fmt.Errorf("%d of %d samples failed, exceeding the threshold of %g%%, no records sent: %w", e.Failed, e.Total, opts.sampleErrorThreshold, e.Err)
+	}
+
+	switch opts.sampleErrorPolicy {
+	case FailBeforeSend:
+		return false, fmt.Errorf("%d of %d samples failed, no records sent: %w", e.Failed, e.Total, e.Err)
+	case SendAndWarn:
+		if opts.sampleErrorReporter != nil {
+			opts.sampleErrorReporter(e)
+		}
+		return true, nil
+	}
+	return true, e.Err
+}
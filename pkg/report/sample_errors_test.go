@@ -0,0 +1,131 @@
+package report_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/metrics"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+func sampleErrorTestCase() (staticQuerier, report.ReportArgs, time.Time) {
+	prom := staticQuerier{
+		sample("SO00000", "instance-a", 1),
+		{Metric: model.Metric{"instance": "instance-b"}, Value: 2},
+		sample("SO00000", "instance-c", 3),
+		sample("SO00000", "instance-d", 4),
+	}
+	args := getReportArgs()
+	args.InstanceJsonnet = `local labels = std.extVar("labels"); labels.instance`
+	return prom, args, time.Date(2020, time.January, 23, 17, 0, 0, 0, time.UTC)
+}
+
+func TestReport_SampleErrorPolicy_SendAndFailByDefault(t *testing.T) {
+	prom, args, from := sampleErrorTestCase()
+	o := &MockOdooClient{}
+
+	require.ErrorContains(t, report.Run(context.Background(), o, prom, args, from), "expected sample to contain label 'sales_order'")
+	require.Len(t, o.lastReceivedData, 3)
+}
+
+func TestReport_RecordsMetrics(t *testing.T) {
+	prom, args, from := sampleErrorTestCase()
+	m := metrics.New()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, m.Register(registry))
+
+	require.NoError(t, report.Run(context.Background(), &MockOdooClient{}, prom, args, from,
+		report.WithSampleErrorPolicy(report.SendAndWarn), report.WithMetrics(m)))
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP appuio_reporting_last_successful_report_timestamp_seconds Beginning of the last timerange that was reported successfully, as Unix timestamp.
+# TYPE appuio_reporting_last_successful_report_timestamp_seconds gauge
+appuio_reporting_last_successful_report_timestamp_seconds{product="myProductId"} 1.5797988e+09
+# HELP appuio_reporting_records_sent_total Number of records that were sent successfully.
+# TYPE appuio_reporting_records_sent_total counter
+appuio_reporting_records_sent_total{product="myProductId"} 3
+# HELP appuio_reporting_sample_failures_total Number of samples that could not be processed into records.
+# TYPE appuio_reporting_sample_failures_total counter
+appuio_reporting_sample_failures_total{product="myProductId"} 1
+# HELP appuio_reporting_samples_total Number of samples returned by the Prometheus queries of a report.
+# TYPE appuio_reporting_samples_total counter
+appuio_reporting_samples_total{product="myProductId"} 4
+`), "appuio_reporting_last_successful_report_timestamp_seconds", "appuio_reporting_records_sent_total",
+		"appuio_reporting_sample_failures_total", "appuio_reporting_samples_total"))
+}
+
+func TestReport_RecordsSampleFailuresPerProduct(t *testing.T) {
+	prom, args, from := sampleErrorTestCase()
+	args.ProductID = ""
+	args.ProductIDJsonnet = `"product-" + std.extVar("labels").instance`
+	m := metrics.New()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, m.Register(registry))
+
+	require.NoError(t, report.Run(context.Background(), &MockOdooClient{}, prom, args, from,
+		report.WithSampleErrorPolicy(report.SendAndWarn), report.WithMetrics(m)))
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP appuio_reporting_sample_failures_total Number of samples that could not be processed into records.
+# TYPE appuio_reporting_sample_failures_total counter
+appuio_reporting_sample_failures_total{product="product-instance-b"} 1
+`), "appuio_reporting_sample_failures_total"))
+}
+
+func TestReport_SampleErrorPolicy_SendAndWarn(t *testing.T) {
+	prom, args, from := sampleErrorTestCase()
+	o := &MockOdooClient{}
+	var warnings []report.SampleErrors
+
+	require.NoError(t, report.Run(context.Background(), o, prom, args, from,
+		report.WithSampleErrorPolicy(report.SendAndWarn),
+		report.WithSampleErrorReporter(func(e report.SampleErrors) { warnings = append(warnings, e) }),
+	))
+	require.Len(t, o.lastReceivedData, 3)
+	require.Len(t, warnings, 1)
+	require.Equal(t, 1, warnings[0].Failed)
+	require.Equal(t, 4, warnings[0].Total)
+	require.Equal(t, from, warnings[0].Timestamp)
+	require.ErrorContains(t, warnings[0].Err, "expected sample to contain label 'sales_order'")
+}
+
+func TestReport_SampleErrorPolicy_FailBeforeSend(t *testing.T) {
+	prom, args, from := sampleErrorTestCase()
+	o := &MockOdooClient{}
+
+	err := report.Run(context.Background(), o, prom, args, from, report.WithSampleErrorPolicy(report.FailBeforeSend))
+	require.ErrorContains(t, err, "1 of 4 samples failed, no records sent")
+	require.Equal(t, 0, o.totalReceived)
+}
+
+func TestReport_SampleErrorThreshold(t *testing.T) {
+	prom, args, from := sampleErrorTestCase()
+	o := &MockOdooClient{}
+
+	require.NoError(t, report.Run(context.Background(), o, prom, args, from,
+		report.WithSampleErrorPolicy(report.SendAndWarn),
+		report.WithSampleErrorThreshold(25),
+	), "25% of the samples failed, which does not exceed the threshold")
+	require.Equal(t, 1, o.totalReceived)
+
+	err := report.Run(context.Background(), o, prom, args, from,
+		report.WithSampleErrorPolicy(report.SendAndWarn),
+		report.WithSampleErrorThreshold(20),
+	)
+	require.ErrorContains(t, err, "exceeding the threshold of 20%")
+	require.Equal(t, 1, o.totalReceived, "no records should be sent if the threshold is exceeded")
+}
+
+func TestParseSampleErrorPolicy(t *testing.T) {
+	p, err := report.ParseSampleErrorPolicy("fail-before-send")
+	require.NoError(t, err)
+	require.Equal(t, report.FailBeforeSend, p)
+
+	_, err = report.ParseSampleErrorPolicy("ignore")
+	require.Error(t, err)
+}
@@ -0,0 +1,137 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/go-jsonnet"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"go.uber.org/multierr"
+)
+
+// snippet is a Jsonnet snippet of the report arguments.
+type snippet struct {
+	name     string
+	filename string
+	code     string
+	required bool
+}
+
+func (args ReportArgs) snippets() []snippet {
+	return []snippet{
+		{name: "instance jsonnet", filename: "instance.json", code: args.InstanceJsonnet, required: true},
+		{name: "item group description jsonnet", filename: "group.json", code: args.ItemGroupDescriptionJsonnet},
+		{name: "item description jsonnet", filename: "description.json", code: args.ItemDescriptionJsonnet},
+		{name: "sales order jsonnet", filename: "sales_order.json", code: args.SalesOrderJsonnet},
+		{name: "product ID jsonnet", filename: "product_id.json", code: args.ProductIDJsonnet},
+		{name: "unit ID jsonnet", filename: "unit_id.json", code: args.UnitIDJsonnet},
+	}
+}
+
+// Validate checks the report arguments without running the report.
+// The query is parsed as PromQL and the Jsonnet snippets are compiled.
+// The snippets are then evaluated against each of the given label sets, the same way as when processing the samples returned by the query.
+// All problems found are returned combined. Problems found for multiple label sets are only returned once.
+func Validate(args ReportArgs, labelSets ...model.Metric) error {
+	var errs error
+	if err := ValidateQuery(args.Query); err != nil {
+		errs = multierr.Append(errs, err)
+	}
+
+	for k := range args.JsonnetExtVars {
+		if slices.Contains(ReservedExtVars, k) {
+			errs = multierr.Append(errs, fmt.Errorf("jsonnet ext var %q is reserved", k))
+		}
+	}
+
+	compiled := make([]snippet, 0, len(args.snippets()))
+	for _, s := range args.snippets() {
+		if s.code == "" {
+			if s.required {
+				errs = multierr.Append(errs, fmt.Errorf("%s is required", s.name))
+			}
+			continue
+		}
+		if _, err := jsonnet.SnippetToAST(s.filename, s.code); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("invalid %s: %w", s.name, err))
+			continue
+		}
+		compiled = append(compiled, s)
+	}
+
+	importer := newJsonnetImporter(args)
+	seen := map[string]bool{}
+	for _, labels := range labelSets {
+		for _, p := range validateLabels(args, importer, compiled, labels) {
+			if seen[p.key] {
+				continue
+			}
+			seen[p.key] = true
+			errs = multierr.Append(errs, p.err)
+		}
+	}
+	return errs
+}
+
+// ValidateQuery parses the query as PromQL.
+func ValidateQuery(query string) error {
+	if _, err := parser.ParseExpr(query); err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+	return nil
+}
+
+// labelProblem is a problem found evaluating the report arguments against a label set.
+// Problems with the same key are considered the same problem.
+type labelProblem struct {
+	key string
+	err error
+}
+
+// validateLabels evaluates the snippets against the labels and checks the labels required to process a sample are present.
+func validateLabels(args ReportArgs, importer jsonnet.Importer, snippets []snippet, labels model.Metric) []labelProblem {
+	problems := make([]labelProblem, 0)
+	if args.SalesOrderJsonnet == "" {
+		if _, err := getFirstMetricLabel(labels, args.salesOrderLabels()); err != nil {
+			problems = append(problems, labelProblem{err.Error(), fmt.Errorf("labels %s: %w", labels, err)})
+		}
+	}
+
+	vm, err := newJsonnetVM(args, importer, args.AlignDown(time.Now()), &model.Sample{Metric: labels})
+	if err != nil {
+		return append(problems, labelProblem{err.Error(), err})
+	}
+	for _, s := range snippets {
+		out, err := vm.EvaluateAnonymousSnippet(s.filename, s.code)
+		if err != nil {
+			problems = append(problems, labelProblem{s.name + err.Error(), fmt.Errorf("%s failed for labels %s: %w", s.name, labels, err)})
+			continue
+		}
+		var str string
+		if err := json.Unmarshal([]byte(out), &str); err != nil {
+			problems = append(problems, labelProblem{s.name + " not a string", fmt.Errorf("%s must evaluate to a string for labels %s, got %s", s.name, labels, out)})
+		}
+	}
+	return problems
+}
+
+// SampleLabels runs the query at the given time and returns the labels of the returned samples.
+func SampleLabels(ctx context.Context, prom PromQuerier, query string, ts time.Time) ([]model.Metric, error) {
+	res, _, err := prom.Query(ctx, query, ts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prometheus: %w", err)
+	}
+	samples, ok := res.(model.Vector)
+	if !ok {
+		return nil, fmt.Errorf("expected prometheus query to return a model.Vector, got %T", res)
+	}
+	labels := make([]model.Metric, 0, len(samples))
+	for _, s := range samples {
+		labels = append(labels, s.Metric)
+	}
+	return labels, nil
+}
@@ -0,0 +1,70 @@
+package report_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+func validArgs() report.ReportArgs {
+	return report.ReportArgs{
+		Query:                       `sum by (sales_order, instance) (rate(usage_total[1h]))`,
+		InstanceJsonnet:             `local labels = std.extVar("labels"); labels.instance`,
+		ItemGroupDescriptionJsonnet: `"group"`,
+		ItemDescriptionJsonnet:      `local labels = std.extVar("labels"); "Usage of %s" % labels.instance`,
+	}
+}
+
+func TestValidate_Valid(t *testing.T) {
+	require.NoError(t, report.Validate(validArgs(), sample("SO1", "a", 1).Metric, sample("SO2", "b", 1).Metric))
+}
+
+func TestValidate_ReportsAllProblems(t *testing.T) {
+	args := validArgs()
+	args.Query = `sum(rate(usage_total[1h])`
+	args.ItemGroupDescriptionJsonnet = `{ group: `
+	args.ItemDescriptionJsonnet = `local labels = std.extVar("labels"); labels.missing`
+
+	errs := multierr.Errors(report.Validate(args, sample("SO1", "a", 1).Metric, sample("SO2", "b", 1).Metric))
+	require.Len(t, errs, 3, "the problem of the item description should only be reported once: %v", errs)
+	require.ErrorContains(t, errs[0], "invalid query")
+	require.ErrorContains(t, errs[1], "invalid item group description jsonnet")
+	require.ErrorContains(t, errs[2], "item description jsonnet failed for labels")
+}
+
+func TestValidate_RequiresStringsAndSalesOrder(t *testing.T) {
+	args := validArgs()
+	args.ItemGroupDescriptionJsonnet = `{ group: "a" }`
+
+	errs := multierr.Errors(report.Validate(args, model.Metric{"instance": "a"}))
+	require.Len(t, errs, 2)
+	require.ErrorContains(t, errs[0], "expected sample to contain label 'sales_order'")
+	require.ErrorContains(t, errs[1], "item group description jsonnet must evaluate to a string")
+
+	args.SalesOrderJsonnet = `"SO1"`
+	require.Len(t, multierr.Errors(report.Validate(args, model.Metric{"instance": "a"})), 1)
+}
+
+func TestValidate_RequiresInstanceJsonnet(t *testing.T) {
+	args := validArgs()
+	args.InstanceJsonnet = ""
+	require.EqualError(t, report.Validate(args), "instance jsonnet is required")
+}
+
+func TestSampleLabels(t *testing.T) {
+	labels, err := report.SampleLabels(context.Background(), staticQuerier{sample("SO1", "a", 1), sample("SO2", "b", 1)}, "usage", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, []model.Metric{sample("SO1", "a", 1).Metric, sample("SO2", "b", 1).Metric}, labels)
+}
+
+func TestValidate_ReservedExtVars(t *testing.T) {
+	args := validArgs()
+	args.JsonnetExtVars = map[string]string{"from": "yesterday", "cluster": "c1"}
+	require.EqualError(t, report.Validate(args), `jsonnet ext var "from" is reserved`)
+}
@@ -0,0 +1,59 @@
+package retry
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy describes how often an operation is retried and how long to wait between the attempts.
+// The zero value disables retries.
+type Policy struct {
+	// MaxRetries is the number of retries after the initial attempt.
+	MaxRetries int
+	// InitialBackoff is the time to wait before the first retry. It is doubled for every further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the time to wait between two attempts. No cap is applied if zero.
+	MaxBackoff time.Duration
+	// Jitter is the fraction by which the backoff is randomized.
+	// A jitter of 0.2 results in a backoff between 80% and 120% of the exponential backoff.
+	Jitter float64
+}
+
+// Backoff returns the time to wait before the given retry. The first retry is 1.
+func (p Policy) Backoff(retry int) time.Duration {
+	if retry < 1 || p.InitialBackoff <= 0 {
+		return 0
+	}
+	d := p.InitialBackoff
+	for i := 1; i < retry; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		// Guard against overflows for large numbers of retries.
+		if d > time.Duration(1<<62) {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// Sleep waits for the given duration or until the context is done.
+// Returns the context's error if it is done before the duration passed.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
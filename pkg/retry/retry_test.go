@@ -0,0 +1,50 @@
+package retry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/retry"
+)
+
+func TestPolicy_Backoff(t *testing.T) {
+	p := retry.Policy{
+		MaxRetries:     10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+	}
+
+	require.Equal(t, time.Duration(0), p.Backoff(0))
+	require.Equal(t, 1*time.Second, p.Backoff(1))
+	require.Equal(t, 2*time.Second, p.Backoff(2))
+	require.Equal(t, 4*time.Second, p.Backoff(3))
+	require.Equal(t, 8*time.Second, p.Backoff(4))
+	require.Equal(t, 10*time.Second, p.Backoff(5))
+	require.Equal(t, 10*time.Second, p.Backoff(1000))
+
+	require.Equal(t, time.Duration(0), retry.Policy{}.Backoff(1))
+}
+
+func TestPolicy_BackoffWithJitter(t *testing.T) {
+	p := retry.Policy{
+		InitialBackoff: time.Second,
+		Jitter:         0.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		b := p.Backoff(2)
+		require.GreaterOrEqual(t, b, time.Second)
+		require.LessOrEqual(t, b, 3*time.Second)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	require.NoError(t, retry.Sleep(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, retry.Sleep(ctx, time.Hour), context.Canceled)
+}
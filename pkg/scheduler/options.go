@@ -0,0 +1,60 @@
+package scheduler
+
+import "time"
+
+type options struct {
+	clock         Clock
+	retryInterval time.Duration
+}
+
+// Option represents a scheduler option.
+type Option interface {
+	set(*options)
+}
+
+func buildOptions(os []Option) options {
+	build := options{
+		clock:         realClock{},
+		retryInterval: 5 * time.Minute,
+	}
+	for _, o := range os {
+		o.set(&build)
+	}
+	return build
+}
+
+// Clock provides the current time and timers to the scheduler.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock allows replacing the clock of the scheduler, for example in tests.
+func WithClock(c Clock) Option {
+	return clockOption{c}
+}
+
+type clockOption struct {
+	Clock
+}
+
+func (c clockOption) set(o *options) {
+	o.clock = c.Clock
+}
+
+// WithRetryInterval sets the time to wait before retrying a failed job. Defaults to 5 minutes.
+// A job is retried earlier if its next timerange completes before.
+func WithRetryInterval(d time.Duration) Option {
+	return retryInterval(d)
+}
+
+type retryInterval time.Duration
+
+func (d retryInterval) set(o *options) {
+	o.retryInterval = time.Duration(d)
+}
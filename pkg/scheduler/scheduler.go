@@ -0,0 +1,183 @@
+// Package scheduler runs reports continuously, each as soon as a timerange is complete.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+// Job is a report run by the scheduler.
+type Job struct {
+	Name string
+	Args report.ReportArgs
+	// Lag is the time to wait after the end of a timerange before it is reported, for example to account for ingestion delays.
+	Lag time.Duration
+	// Begin is the first timerange to report if there is no checkpoint for the job.
+	// If zero, the job starts with the last complete timerange.
+	Begin time.Time
+}
+
+// RunFunc runs the reports of the job for the timeranges from `from` up to `until`.
+// The progress must be written to the checkpoint file, see report.WithCheckpointFile.
+type RunFunc func(ctx context.Context, job Job, from, until time.Time, checkpointFile string) error
+
+// JobStatus is the status of a job.
+type JobStatus struct {
+	// CaughtUp is true once all complete timeranges have been reported successfully at least once since the scheduler started.
+	CaughtUp      bool      `json:"caughtUp"`
+	LastDelivered time.Time `json:"lastDelivered,omitzero"`
+	LastRun       time.Time `json:"lastRun,omitzero"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextRun       time.Time `json:"nextRun,omitzero"`
+}
+
+// Scheduler runs each job whenever one of its timeranges is complete.
+// Missed timeranges, for example after a downtime, are caught up using a checkpoint per job in the state directory.
+type Scheduler struct {
+	stateDir string
+	jobs     []Job
+	run      RunFunc
+	logger   logr.Logger
+	options  options
+
+	mu     sync.Mutex
+	status map[string]JobStatus
+}
+
+// New creates a scheduler for the jobs. The checkpoints of the jobs are stored in stateDir.
+func New(stateDir string, jobs []Job, run RunFunc, logger logr.Logger, opts ...Option) *Scheduler {
+	return &Scheduler{
+		stateDir: stateDir,
+		jobs:     jobs,
+		run:      run,
+		logger:   logger,
+		options:  buildOptions(opts),
+		status:   make(map[string]JobStatus, len(jobs)),
+	}
+}
+
+// CheckpointFile returns the path of the checkpoint file of the job with the given name.
+func (s *Scheduler) CheckpointFile(name string) string {
+	return filepath.Join(s.stateDir, url.PathEscape(name)+".checkpoint.json")
+}
+
+// Run runs the jobs until the context is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	if err := os.MkdirAll(s.stateDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range s.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				next := s.runJob(ctx, job)
+				if ctx.Err() != nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-s.options.clock.After(next.Sub(s.options.clock.Now())):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Status returns the status of all jobs by name.
+func (s *Scheduler) Status() map[string]JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make(map[string]JobStatus, len(s.jobs))
+	for _, job := range s.jobs {
+		status[job.Name] = s.status[job.Name]
+	}
+	return status
+}
+
+// Ready returns true once all jobs have caught up.
+func (s *Scheduler) Ready() bool {
+	for _, st := range s.Status() {
+		if !st.CaughtUp {
+			return false
+		}
+	}
+	return true
+}
+
+// runJob reports all complete timeranges of the job and returns the time it should run next.
+func (s *Scheduler) runJob(ctx context.Context, job Job) time.Time {
+	log := s.logger.WithValues("report", job.Name)
+	now := s.options.clock.Now()
+	// A timerange can be reported once it ended and the lag passed.
+	reportable := now.Add(-job.Lag)
+
+	st := s.jobStatus(job.Name)
+	st.LastRun = now
+
+	checkpointFile := s.CheckpointFile(job.Name)
+	begin := job.Begin
+	if begin.IsZero() {
+		// The start of the last complete timerange.
+		begin = job.Args.AlignDown(job.Args.AlignDown(reportable).Add(-time.Nanosecond))
+	}
+	from, err := report.ResumeFrom(checkpointFile, job.Args, begin)
+	if err != nil {
+		from = begin
+	}
+	until := from
+	for end := job.Args.TimerangeEnd(until); end.After(until) && !end.After(reportable); end = job.Args.TimerangeEnd(until) {
+		until = end
+	}
+	next := job.Args.TimerangeEnd(until).Add(job.Lag)
+	st.NextRun = next
+
+	if err == nil && until.After(from) {
+		log.Info("Running reports", "from", from.Format(time.RFC3339), "until", until.Format(time.RFC3339))
+		err = s.run(ctx, job, from, until, checkpointFile)
+	}
+
+	if c, ok, cerr := report.ReadCheckpoint(checkpointFile); cerr == nil && ok {
+		st.LastDelivered = c.LastDelivered
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Error(err, "Report failed, retrying later", "retryInterval", s.options.retryInterval)
+		}
+		st.LastError = err.Error()
+		if retry := now.Add(s.options.retryInterval); retry.Before(next) {
+			st.NextRun = retry
+		}
+	} else {
+		st.LastError = ""
+		st.CaughtUp = true
+	}
+	s.setJobStatus(job.Name, st)
+	return st.NextRun
+}
+
+func (s *Scheduler) jobStatus(name string) JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status[name]
+}
+
+func (s *Scheduler) setJobStatus(name string, st JobStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[name] = st
+}
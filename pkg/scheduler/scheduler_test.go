@@ -0,0 +1,117 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/report"
+	"github.com/appuio/appuio-reporting/pkg/scheduler"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After advances the clock immediately.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+type run struct {
+	from, until, at time.Time
+}
+
+func testJob() scheduler.Job {
+	return scheduler.Job{
+		Name:  "storage",
+		Args:  report.ReportArgs{ProductID: "p", TimerangeSize: time.Hour},
+		Lag:   15 * time.Minute,
+		Begin: time.Date(2023, 7, 8, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestScheduler_CatchesUpAndRunsEachTimerange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Date(2023, 7, 8, 15, 10, 0, 0, time.UTC)}
+
+	var runs []run
+	s := scheduler.New(t.TempDir(), []scheduler.Job{testJob()}, func(ctx context.Context, job scheduler.Job, from, until time.Time, checkpointFile string) error {
+		runs = append(runs, run{from, until, clock.Now()})
+		if len(runs) == 3 {
+			cancel()
+		}
+		return report.WriteCheckpoint(checkpointFile, report.Checkpoint{ProductID: job.Args.ProductID, LastDelivered: until.Add(-job.Args.TimerangeSize)})
+	}, logr.Discard(), scheduler.WithClock(clock))
+
+	require.ErrorIs(t, s.Run(ctx), context.Canceled)
+	require.Equal(t, []run{
+		{time.Date(2023, 7, 8, 10, 0, 0, 0, time.UTC), time.Date(2023, 7, 8, 14, 0, 0, 0, time.UTC), time.Date(2023, 7, 8, 15, 10, 0, 0, time.UTC)},
+		{time.Date(2023, 7, 8, 14, 0, 0, 0, time.UTC), time.Date(2023, 7, 8, 15, 0, 0, 0, time.UTC), time.Date(2023, 7, 8, 15, 15, 0, 0, time.UTC)},
+		{time.Date(2023, 7, 8, 15, 0, 0, 0, time.UTC), time.Date(2023, 7, 8, 16, 0, 0, 0, time.UTC), time.Date(2023, 7, 8, 16, 15, 0, 0, time.UTC)},
+	}, runs)
+	require.True(t, s.Ready())
+	require.Equal(t, time.Date(2023, 7, 8, 15, 0, 0, 0, time.UTC), s.Status()["storage"].LastDelivered)
+}
+
+func TestScheduler_ResumesFromCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Date(2023, 7, 8, 15, 10, 0, 0, time.UTC)}
+	job := testJob()
+
+	var runs []run
+	s := scheduler.New(t.TempDir(), []scheduler.Job{job}, func(ctx context.Context, job scheduler.Job, from, until time.Time, checkpointFile string) error {
+		runs = append(runs, run{from, until, clock.Now()})
+		cancel()
+		return nil
+	}, logr.Discard(), scheduler.WithClock(clock))
+	require.NoError(t, report.WriteCheckpoint(s.CheckpointFile(job.Name), report.Checkpoint{ProductID: "p", LastDelivered: time.Date(2023, 7, 8, 12, 0, 0, 0, time.UTC)}))
+
+	require.ErrorIs(t, s.Run(ctx), context.Canceled)
+	require.Len(t, runs, 1)
+	require.Equal(t, time.Date(2023, 7, 8, 13, 0, 0, 0, time.UTC), runs[0].from)
+}
+
+func TestScheduler_RetriesFailedJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Date(2023, 7, 8, 15, 10, 0, 0, time.UTC)}
+
+	var s *scheduler.Scheduler
+	var runs []run
+	s = scheduler.New(t.TempDir(), []scheduler.Job{testJob()}, func(ctx context.Context, job scheduler.Job, from, until time.Time, checkpointFile string) error {
+		runs = append(runs, run{from, until, clock.Now()})
+		if len(runs) == 1 {
+			return errors.New("odoo unavailable")
+		}
+		require.False(t, s.Ready(), "should not be ready before the first successful run")
+		require.Equal(t, "odoo unavailable", s.Status()["storage"].LastError)
+		cancel()
+		return nil
+	}, logr.Discard(), scheduler.WithClock(clock), scheduler.WithRetryInterval(time.Minute))
+
+	require.ErrorIs(t, s.Run(ctx), context.Canceled)
+	require.Len(t, runs, 2)
+	require.Equal(t, time.Date(2023, 7, 8, 15, 11, 0, 0, time.UTC), runs[1].at)
+	require.Equal(t, runs[0].from, runs[1].from, "the failed timeranges should be retried")
+	require.True(t, s.Ready())
+}
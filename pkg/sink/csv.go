@@ -0,0 +1,94 @@
+package sink
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+// CSVColumns maps the available CSV column names to functions extracting the value from a record.
+var CSVColumns = map[string]func(odoo.OdooMeteredBillingRecord) string{
+	"product_id":             func(r odoo.OdooMeteredBillingRecord) string { return r.ProductID },
+	"instance_id":            func(r odoo.OdooMeteredBillingRecord) string { return r.InstanceID },
+	"item_description":       func(r odoo.OdooMeteredBillingRecord) string { return r.ItemDescription },
+	"item_group_description": func(r odoo.OdooMeteredBillingRecord) string { return r.ItemGroupDescription },
+	"sales_order_id":         func(r odoo.OdooMeteredBillingRecord) string { return r.SalesOrderID },
+	"unit_id":                func(r odoo.OdooMeteredBillingRecord) string { return r.UnitID },
+	"consumed_units": func(r odoo.OdooMeteredBillingRecord) string {
+		return strconv.FormatFloat(r.ConsumedUnits, 'f', -1, 64)
+	},
+	"timerange_from": func(r odoo.OdooMeteredBillingRecord) string { return r.Timerange.From.Format(time.RFC3339) },
+	"timerange_to":   func(r odoo.OdooMeteredBillingRecord) string { return r.Timerange.To.Format(time.RFC3339) },
+}
+
+// DefaultCSVColumns are the columns written if no columns are configured.
+var DefaultCSVColumns = []string{
+	"product_id",
+	"instance_id",
+	"sales_order_id",
+	"unit_id",
+	"consumed_units",
+	"timerange_from",
+	"timerange_to",
+	"item_group_description",
+	"item_description",
+}
+
+// CSVSink writes records as CSV rows.
+// CSVSink is safe for concurrent use.
+type CSVSink struct {
+	columns []string
+	header  bool
+
+	mu            sync.Mutex
+	w             *csv.Writer
+	headerWritten bool
+}
+
+// NewCSVSink returns a sink writing the given columns to w.
+// DefaultCSVColumns are used if no columns are given. If header is true, the column names are written as the first row.
+func NewCSVSink(w io.Writer, columns []string, header bool) (*CSVSink, error) {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+	for _, c := range columns {
+		if _, ok := CSVColumns[c]; !ok {
+			return nil, fmt.Errorf("unknown CSV column %q", c)
+		}
+	}
+	return &CSVSink{
+		columns: columns,
+		header:  header,
+		w:       csv.NewWriter(w),
+	}, nil
+}
+
+// SendData writes the records to the CSV file.
+func (s *CSVSink) SendData(_ context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.header && !s.headerWritten {
+		if err := s.w.Write(s.columns); err != nil {
+			return fmt.Errorf("failed to write CSV header: %w", err)
+		}
+		s.headerWritten = true
+	}
+	row := make([]string, len(s.columns))
+	for _, r := range data {
+		for i, c := range s.columns {
+			row[i] = CSVColumns[c](r)
+		}
+		if err := s.w.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+	s.w.Flush()
+	return s.w.Error()
+}
@@ -0,0 +1,55 @@
+package sink_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/sink"
+)
+
+func TestCSVSink(t *testing.T) {
+	out := &bytes.Buffer{}
+	uut, err := sink.NewCSVSink(out, nil, true)
+	require.NoError(t, err)
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("my-instance")}))
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("other, instance")}))
+
+	require.Equal(t, `product_id,instance_id,sales_order_id,unit_id,consumed_units,timerange_from,timerange_to,item_group_description,item_description
+my-product,my-instance,SO00000,my-unit,11.1,2022-02-22T22:00:00Z,2022-02-22T23:00:00Z,my-group,my-description
+my-product,"other, instance",SO00000,my-unit,11.1,2022-02-22T22:00:00Z,2022-02-22T23:00:00Z,my-group,my-description
+`, out.String())
+}
+
+func TestCSVSink_Columns(t *testing.T) {
+	out := &bytes.Buffer{}
+	uut, err := sink.NewCSVSink(out, []string{"sales_order_id", "consumed_units"}, false)
+	require.NoError(t, err)
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("my-instance")}))
+	require.Equal(t, "SO00000,11.1\n", out.String())
+
+	_, err = sink.NewCSVSink(out, []string{"unknown"}, false)
+	require.ErrorContains(t, err, `unknown CSV column "unknown"`)
+}
+
+func getRecord(instance string) odoo.OdooMeteredBillingRecord {
+	return odoo.OdooMeteredBillingRecord{
+		ProductID:            "my-product",
+		UnitID:               "my-unit",
+		SalesOrderID:         "SO00000",
+		InstanceID:           instance,
+		ItemDescription:      "my-description",
+		ItemGroupDescription: "my-group",
+		ConsumedUnits:        11.1,
+		Timerange: odoo.Timerange{
+			From: time.Date(2022, 2, 22, 22, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 2, 22, 23, 0, 0, 0, time.UTC),
+		},
+	}
+}
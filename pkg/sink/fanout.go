@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+// Client is the interface implemented by all sinks. It matches report.OdooClient.
+type Client interface {
+	SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error
+}
+
+// Named is a sink with a name used in logs and error messages.
+type Named struct {
+	Name string
+	Client
+}
+
+// Mode defines how FanOut handles sinks failing to deliver records.
+type Mode string
+
+const (
+	// AllMustSucceed fails if any sink failed to deliver the records.
+	AllMustSucceed Mode = "all"
+	// BestEffort logs a warning for sinks that failed to deliver the records.
+	// It only fails if all sinks failed.
+	BestEffort Mode = "best-effort"
+)
+
+// ParseMode parses the given fan-out mode.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case AllMustSucceed, BestEffort:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown sink mode %q, expected one of %q, %q", s, AllMustSucceed, BestEffort)
+}
+
+// FanOut delivers each batch of records to all sinks.
+// The records are delivered to every sink even if delivering them to another sink failed.
+type FanOut struct {
+	sinks  []Named
+	mode   Mode
+	logger logr.Logger
+}
+
+// NewFanOut returns a sink delivering records to all given sinks.
+func NewFanOut(mode Mode, logger logr.Logger, sinks ...Named) *FanOut {
+	return &FanOut{
+		sinks:  sinks,
+		mode:   mode,
+		logger: logger,
+	}
+}
+
+type failure struct {
+	sink string
+	err  error
+}
+
+// SendData delivers the records to all sinks.
+func (f *FanOut) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	failures := make([]failure, 0)
+	for _, s := range f.sinks {
+		if err := s.SendData(ctx, data); err != nil {
+			failures = append(failures, failure{s.Name, err})
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+
+	if f.mode == BestEffort && len(failures) < len(f.sinks) {
+		for _, fail := range failures {
+			f.logger.Info("Warning: failed to deliver records to sink", "sink", fail.sink, "error", fail.err.Error(), "numberOfRecords", len(data))
+		}
+		return nil
+	}
+	return combineFailures(failures)
+}
+
+// combineFailures combines the errors of the failed sinks.
+// A *odoo.ChunkError states which records have been delivered. It is only kept if it holds for all sinks,
+// that is if all failed sinks returned one. In that case the one with the smallest offset is returned first, so that errors.As finds it.
+// Otherwise only the underlying errors are wrapped.
+func combineFailures(failures []failure) error {
+	allChunkErrors := true
+	for _, fail := range failures {
+		var chunkErr *odoo.ChunkError
+		if !errors.As(fail.err, &chunkErr) {
+			allChunkErrors = false
+		}
+	}
+	if allChunkErrors {
+		sort.SliceStable(failures, func(i, j int) bool {
+			var a, b *odoo.ChunkError
+			errors.As(failures[i].err, &a)
+			errors.As(failures[j].err, &b)
+			return a.Offset < b.Offset
+		})
+	}
+
+	var errs error
+	for i, fail := range failures {
+		var chunkErr *odoo.ChunkError
+		if errors.As(fail.err, &chunkErr) && (!allChunkErrors || i > 0) {
+			errs = multierr.Append(errs, fmt.Errorf("sink %s: %s: %w", fail.sink, chunkErr.Error(), chunkErr.Err))
+			continue
+		}
+		errs = multierr.Append(errs, fmt.Errorf("sink %s: %w", fail.sink, fail.err))
+	}
+	return errs
+}
@@ -0,0 +1,84 @@
+package sink_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/sink"
+)
+
+func TestFanOut_AllMustSucceed(t *testing.T) {
+	first, second, third := &recordingSink{}, &recordingSink{err: errors.New("sink is down")}, &recordingSink{}
+	uut := sink.NewFanOut(sink.AllMustSucceed, logr.Discard(),
+		sink.Named{Name: "first", Client: first},
+		sink.Named{Name: "second", Client: second},
+		sink.Named{Name: "third", Client: third},
+	)
+
+	err := uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("a")})
+	require.EqualError(t, err, "sink second: sink is down")
+	require.Len(t, first.received, 1)
+	require.Len(t, second.received, 1)
+	require.Len(t, third.received, 1, "records should be delivered to all sinks even if one failed")
+}
+
+func TestFanOut_BestEffort(t *testing.T) {
+	first, second := &recordingSink{}, &recordingSink{err: errors.New("sink is down")}
+	uut := sink.NewFanOut(sink.BestEffort, logr.Discard(),
+		sink.Named{Name: "first", Client: first},
+		sink.Named{Name: "second", Client: second},
+	)
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("a")}))
+	require.Len(t, first.received, 1)
+
+	first.err = errors.New("first is down too")
+	require.Error(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("a")}), "should fail if all sinks failed")
+}
+
+func TestFanOut_KeepsChunkErrorOnlyIfValidForAllSinks(t *testing.T) {
+	chunkErr := func(offset int) error {
+		return &odoo.ChunkError{Chunk: 2, Chunks: 3, Offset: offset, Count: 1, Err: &odoo.APIError{StatusCode: 400}}
+	}
+
+	uut := sink.NewFanOut(sink.AllMustSucceed, logr.Discard(),
+		sink.Named{Name: "first", Client: &recordingSink{err: chunkErr(4)}},
+		sink.Named{Name: "second", Client: &recordingSink{err: chunkErr(2)}},
+	)
+	var ce *odoo.ChunkError
+	require.True(t, errors.As(uut.SendData(context.Background(), nil), &ce))
+	require.Equal(t, 2, ce.Offset, "the smallest offset should be reported")
+
+	uut = sink.NewFanOut(sink.AllMustSucceed, logr.Discard(),
+		sink.Named{Name: "first", Client: &recordingSink{err: chunkErr(4)}},
+		sink.Named{Name: "second", Client: &recordingSink{err: errors.New("sink is down")}},
+	)
+	err := uut.SendData(context.Background(), nil)
+	require.False(t, errors.As(err, &ce), "no records have been delivered to the second sink")
+	var apiErr *odoo.APIError
+	require.True(t, errors.As(err, &apiErr))
+}
+
+func TestParseMode(t *testing.T) {
+	m, err := sink.ParseMode("best-effort")
+	require.NoError(t, err)
+	require.Equal(t, sink.BestEffort, m)
+
+	_, err = sink.ParseMode("some")
+	require.Error(t, err)
+}
+
+type recordingSink struct {
+	err      error
+	received []odoo.OdooMeteredBillingRecord
+}
+
+func (s *recordingSink) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	s.received = append(s.received, data...)
+	return s.err
+}
@@ -0,0 +1,38 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+// JSONLSink writes each record as a JSON object on its own line.
+// The records are encoded the same way as in the requests sent to the Odoo API.
+// JSONLSink is safe for concurrent use.
+type JSONLSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLSink returns a sink writing records to w.
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// SendData writes the records to the JSON Lines file.
+func (s *JSONLSink) SendData(_ context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range data {
+		if err := s.enc.Encode(r); err != nil {
+			return fmt.Errorf("failed to write record: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package sink_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/sink"
+)
+
+func TestJSONLSink(t *testing.T) {
+	out := &bytes.Buffer{}
+	uut := sink.NewJSONLSink(out)
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("a"), getRecord("b")}))
+	require.NoError(t, uut.SendData(context.Background(), nil))
+
+	require.Equal(t, `{"product_id":"my-product","instance_id":"a","item_description":"my-description","item_group_description":"my-group","sales_order_id":"SO00000","unit_id":"my-unit","consumed_units":11.1,"timerange":"2022-02-22T22:00:00Z/2022-02-22T23:00:00Z"}
+{"product_id":"my-product","instance_id":"b","item_description":"my-description","item_group_description":"my-group","sales_order_id":"SO00000","unit_id":"my-unit","consumed_units":11.1,"timerange":"2022-02-22T22:00:00Z/2022-02-22T23:00:00Z"}
+`, out.String())
+}
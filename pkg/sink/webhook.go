@@ -0,0 +1,263 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+)
+
+// DefaultWebhookBodyJsonnet is the body template used if no template is configured. It sends the records as a JSON array.
+const DefaultWebhookBodyJsonnet = `std.extVar("records")`
+
+// DefaultWebhookTimeout is the timeout of the requests if no HTTP client is configured.
+const DefaultWebhookTimeout = 30 * time.Second
+
+// maxWebhookErrorBody is the maximum number of bytes of the response body included in errors.
+const maxWebhookErrorBody = 1024
+
+// Webhook sends records to an HTTP endpoint.
+// The request body is rendered from the records using a Jsonnet template.
+// The records are available in the template as external variable `records`, encoded the same way as in the requests sent to the Odoo API.
+// The template can import files from the Jsonnet library paths and use the external variables set with WithJsonnetLibraryPaths and WithJsonnetExtVars.
+// Webhook is safe for concurrent use.
+type Webhook struct {
+	url     string
+	body    ast.Node
+	options webhookOptions
+}
+
+// NewWebhook returns a sink sending records to the given URL.
+// bodyJsonnet is the Jsonnet template rendering the request body. DefaultWebhookBodyJsonnet is used if it is empty.
+// Returns an error if the template can't be parsed.
+func NewWebhook(url string, bodyJsonnet string, opts ...WebhookOption) (*Webhook, error) {
+	if bodyJsonnet == "" {
+		bodyJsonnet = DefaultWebhookBodyJsonnet
+	}
+	body, err := jsonnet.SnippetToAST("webhook-body", bodyJsonnet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webhook body template: %w", err)
+	}
+	return &Webhook{
+		url:     url,
+		body:    body,
+		options: buildWebhookOptions(opts),
+	}, nil
+}
+
+// SendData renders the request body from the records and sends it to the webhook.
+// Returns an error if the webhook did not respond with a success status code.
+func (w *Webhook) SendData(ctx context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	body, err := w.render(data)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, w.options.method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.options.headers {
+		req.Header[k] = v
+	}
+	if w.options.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.options.bearerToken)
+	}
+	if w.options.basicAuthUsername != "" {
+		req.SetBasicAuth(w.options.basicAuthUsername, w.options.basicAuthPassword)
+	}
+
+	resp, err := w.options.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send records to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if !w.isSuccess(resp.StatusCode) {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookErrorBody))
+		return fmt.Errorf("webhook responded with status %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// render evaluates the body template with the given records.
+func (w *Webhook) render(data []odoo.OdooMeteredBillingRecord) ([]byte, error) {
+	records, err := json.Marshal(ensureJSONArray(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode records: %w", err)
+	}
+	vm := jsonnet.MakeVM()
+	// The importer caches the imported files and is not safe for concurrent use, so every rendering gets its own.
+	vm.Importer(&jsonnet.FileImporter{JPaths: w.options.jsonnetLibraryPaths})
+	for k, v := range w.options.jsonnetExtVars {
+		vm.ExtVar(k, v)
+	}
+	vm.ExtCode("records", string(records))
+	body, err := vm.Evaluate(w.body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render webhook body: %w", err)
+	}
+	return []byte(body), nil
+}
+
+func (w *Webhook) isSuccess(status int) bool {
+	if len(w.options.successStatusCodes) == 0 {
+		return status >= 200 && status < 300
+	}
+	return slices.Contains(w.options.successStatusCodes, status)
+}
+
+// ensureJSONArray makes sure a nil slice of records is encoded as an empty array instead of `null`.
+func ensureJSONArray(data []odoo.OdooMeteredBillingRecord) []odoo.OdooMeteredBillingRecord {
+	if data == nil {
+		return []odoo.OdooMeteredBillingRecord{}
+	}
+	return data
+}
+
+// WebhookOption configures a Webhook.
+type WebhookOption interface {
+	set(*webhookOptions)
+}
+
+type webhookOptions struct {
+	client             *http.Client
+	timeout            time.Duration
+	method             string
+	headers            http.Header
+	bearerToken        string
+	basicAuthUsername  string
+	basicAuthPassword  string
+	successStatusCodes []int
+
+	jsonnetLibraryPaths []string
+	jsonnetExtVars      map[string]string
+}
+
+func buildWebhookOptions(os []WebhookOption) webhookOptions {
+	build := webhookOptions{
+		timeout: DefaultWebhookTimeout,
+		method:  http.MethodPost,
+		headers: http.Header{},
+	}
+	for _, o := range os {
+		o.set(&build)
+	}
+	if build.client == nil {
+		build.client = &http.Client{Timeout: build.timeout}
+	}
+	return build
+}
+
+// WithHTTPClient sets the HTTP client used to send the requests.
+// The timeout of the client is used instead of the one set with WithTimeout.
+func WithHTTPClient(c *http.Client) WebhookOption {
+	return httpClientOption{c}
+}
+
+type httpClientOption struct{ c *http.Client }
+
+func (o httpClientOption) set(opts *webhookOptions) {
+	opts.client = o.c
+}
+
+// WithTimeout sets the timeout of the requests, including reading the response. Defaults to DefaultWebhookTimeout, 0 means no timeout.
+func WithTimeout(d time.Duration) WebhookOption {
+	return timeoutOption(d)
+}
+
+type timeoutOption time.Duration
+
+func (o timeoutOption) set(opts *webhookOptions) {
+	opts.timeout = time.Duration(o)
+}
+
+// WithMethod sets the HTTP method of the requests. Defaults to POST.
+func WithMethod(method string) WebhookOption {
+	return methodOption(method)
+}
+
+type methodOption string
+
+func (o methodOption) set(opts *webhookOptions) {
+	opts.method = string(o)
+}
+
+// WithHeader adds a header to the requests. Can be given multiple times.
+// Overrides the default Content-Type header of `application/json`.
+func WithHeader(key, value string) WebhookOption {
+	return headerOption{key, value}
+}
+
+type headerOption struct{ key, value string }
+
+func (o headerOption) set(opts *webhookOptions) {
+	opts.headers.Add(o.key, o.value)
+}
+
+// WithBearerToken authenticates the requests with the given bearer token.
+func WithBearerToken(token string) WebhookOption {
+	return bearerTokenOption(token)
+}
+
+type bearerTokenOption string
+
+func (o bearerTokenOption) set(opts *webhookOptions) {
+	opts.bearerToken = string(o)
+}
+
+// WithBasicAuth authenticates the requests using HTTP basic authentication.
+func WithBasicAuth(username, password string) WebhookOption {
+	return basicAuthOption{username, password}
+}
+
+type basicAuthOption struct{ username, password string }
+
+func (o basicAuthOption) set(opts *webhookOptions) {
+	opts.basicAuthUsername = o.username
+	opts.basicAuthPassword = o.password
+}
+
+// WithSuccessStatusCodes sets the status codes considered a successful delivery. Defaults to any 2xx status code.
+func WithSuccessStatusCodes(codes ...int) WebhookOption {
+	return successStatusCodesOption(codes)
+}
+
+type successStatusCodesOption []int
+
+func (o successStatusCodesOption) set(opts *webhookOptions) {
+	opts.successStatusCodes = o
+}
+
+// WithJsonnetLibraryPaths sets the directories searched for files imported by the body template.
+// Imports are always resolved relative to the working directory first.
+func WithJsonnetLibraryPaths(paths ...string) WebhookOption {
+	return jsonnetLibraryPathsOption(paths)
+}
+
+type jsonnetLibraryPathsOption []string
+
+func (o jsonnetLibraryPathsOption) set(opts *webhookOptions) {
+	opts.jsonnetLibraryPaths = o
+}
+
+// WithJsonnetExtVars sets additional external variables available to the body template.
+// A variable named `records` is shadowed by the records.
+func WithJsonnetExtVars(vars map[string]string) WebhookOption {
+	return jsonnetExtVarsOption(vars)
+}
+
+type jsonnetExtVarsOption map[string]string
+
+func (o jsonnetExtVarsOption) set(opts *webhookOptions) {
+	opts.jsonnetExtVars = o
+}
@@ -0,0 +1,122 @@
+package sink_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/sink"
+)
+
+func TestWebhook_RendersBodyFromTemplate(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	uut, err := sink.NewWebhook(srv.URL+"/usage", `{
+		usage: [{ customer: r.sales_order_id, amount: r.consumed_units, period: r.timerange } for r in std.extVar("records")],
+	}`,
+		sink.WithMethod(http.MethodPut),
+		sink.WithHeader("X-Tenant", "acme"),
+		sink.WithBearerToken("secret"),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("a")}))
+	require.Equal(t, http.MethodPut, req.Method)
+	require.Equal(t, "/usage", req.URL.Path)
+	require.Equal(t, "acme", req.Header.Get("X-Tenant"))
+	require.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+	require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	require.JSONEq(t, `{"usage":[{"customer":"SO00000","amount":11.1,"period":"2022-02-22T22:00:00Z/2022-02-22T23:00:00Z"}]}`, string(body))
+}
+
+func TestWebhook_JsonnetLibraryPathsAndExtVars(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usage.libsonnet"), []byte(`{ usage(r, tenant): { tenant: tenant, customer: r.sales_order_id } }`), 0o644))
+
+	uut, err := sink.NewWebhook(srv.URL, `local lib = import "usage.libsonnet"; [lib.usage(r, std.extVar("tenant")) for r in std.extVar("records")]`,
+		sink.WithJsonnetLibraryPaths(dir),
+		sink.WithJsonnetExtVars(map[string]string{"tenant": "acme"}),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, uut.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{getRecord("a")}))
+	require.JSONEq(t, `[{"tenant":"acme","customer":"SO00000"}]`, string(body))
+}
+
+func TestWebhook_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	uut, err := sink.NewWebhook(srv.URL, "", sink.WithTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	err = uut.SendData(context.Background(), nil)
+	require.ErrorContains(t, err, "Client.Timeout exceeded")
+}
+
+func TestWebhook_DefaultTemplate(t *testing.T) {
+	var body []byte
+	var user, password string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		user, password, _ = r.BasicAuth()
+	}))
+	defer srv.Close()
+
+	uut, err := sink.NewWebhook(srv.URL, "", sink.WithBasicAuth("user", "pass"))
+	require.NoError(t, err)
+
+	require.NoError(t, uut.SendData(context.Background(), nil))
+	require.JSONEq(t, `[]`, string(body))
+	require.Equal(t, "user", user)
+	require.Equal(t, "pass", password)
+}
+
+func TestWebhook_SuccessStatusCodes(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("try again later"))
+	}))
+	defer srv.Close()
+
+	uut, err := sink.NewWebhook(srv.URL, "", sink.WithSuccessStatusCodes(http.StatusCreated))
+	require.NoError(t, err)
+
+	require.EqualError(t, uut.SendData(context.Background(), nil), "webhook responded with status 200 OK: try again later")
+	status = http.StatusCreated
+	require.NoError(t, uut.SendData(context.Background(), nil))
+}
+
+func TestWebhook_InvalidTemplate(t *testing.T) {
+	_, err := sink.NewWebhook("http://localhost", `{ usage: `)
+	require.Error(t, err)
+
+	uut, err := sink.NewWebhook("http://localhost", `error "no usage"`)
+	require.NoError(t, err)
+	require.ErrorContains(t, uut.SendData(context.Background(), nil), "no usage")
+}
@@ -0,0 +1,120 @@
+// Package timeexpr resolves absolute and relative time expressions such as "now/h-3h" or "start-of-last-month".
+package timeexpr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse resolves the expression relative to now, in UTC. See ParseInLocation.
+func Parse(expr string, now time.Time) (time.Time, error) {
+	return ParseInLocation(expr, now, time.UTC)
+}
+
+// ParseInLocation resolves the expression relative to now.
+// Calendar months and days of the bases and the truncation to days and months are in the given location.
+// The result is always in UTC.
+//
+// An expression is either a timestamp in the form of RFC3339, or a base followed by any number of operations applied from left to right.
+// The base is one of:
+//
+//	now                  the current time
+//	start-of-last-month  the first instant of the previous calendar month
+//	end-of-last-month    the end of the previous calendar month, which is the first instant of the current month
+//
+// The operations are:
+//
+//	+<duration>, -<duration>  add or subtract a duration, in the form of time.ParseDuration or a number of days like 7d
+//	/<unit>                   truncate to the start of the minute (m), hour (h), day (d) or month (M)
+//
+// For example, "now/h-2h" is the start of the hour two hours before the current one.
+func ParseInLocation(expr string, now time.Time, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, expr); err == nil {
+		return t.UTC(), nil
+	}
+
+	now = now.In(loc)
+	rest := expr
+	var t time.Time
+	switch {
+	case strings.HasPrefix(rest, "now"):
+		t, rest = now, rest[len("now"):]
+	case strings.HasPrefix(rest, "start-of-last-month"):
+		t, rest = startOfMonth(now).AddDate(0, -1, 0), rest[len("start-of-last-month"):]
+	case strings.HasPrefix(rest, "end-of-last-month"):
+		t, rest = startOfMonth(now), rest[len("end-of-last-month"):]
+	default:
+		return time.Time{}, fmt.Errorf("invalid time expression %q: expected a timestamp in the form of RFC3339 (%s), now, start-of-last-month or end-of-last-month", expr, time.RFC3339)
+	}
+
+	for rest != "" {
+		op := rest[0]
+		end := strings.IndexAny(rest[1:], "+-/") + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		arg := rest[1:end]
+		rest = rest[end:]
+
+		var err error
+		switch op {
+		case '+', '-':
+			var d time.Duration
+			d, err = parseDuration(arg)
+			if op == '-' {
+				d = -d
+			}
+			t = t.Add(d)
+		case '/':
+			t, err = truncate(t, arg)
+		default:
+			err = fmt.Errorf("unexpected %q, expected +, - or /", string(op))
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time expression %q: %w", expr, err)
+		}
+	}
+	return t.UTC(), nil
+}
+
+// IsAbsolute returns true if the expression is a timestamp in the form of RFC3339.
+func IsAbsolute(expr string) bool {
+	_, err := time.Parse(time.RFC3339, expr)
+	return err == nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func truncate(t time.Time, unit string) (time.Time, error) {
+	switch unit {
+	case "m":
+		return t.Truncate(time.Minute), nil
+	case "h":
+		return t.Truncate(time.Hour), nil
+	case "d":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()), nil
+	case "M":
+		return startOfMonth(t), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid unit %q, expected m, h, d or M", unit)
+}
+
+// startOfMonth returns the first instant of the month of t, in the location of t.
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,82 @@
+package timeexpr_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/timeexpr"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2023, 3, 15, 13, 42, 7, 0, time.FixedZone("CET", 3600))
+
+	tcs := map[string]time.Time{
+		"2023-07-08T13:00:00Z":      time.Date(2023, 7, 8, 13, 0, 0, 0, time.UTC),
+		"2023-07-08T15:00:00+02:00": time.Date(2023, 7, 8, 13, 0, 0, 0, time.UTC),
+		"now":                       time.Date(2023, 3, 15, 12, 42, 7, 0, time.UTC),
+		"now-3h":                    time.Date(2023, 3, 15, 9, 42, 7, 0, time.UTC),
+		"now/h-2h":                  time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC),
+		"now-2h/h":                  time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC),
+		"now+30m/m":                 time.Date(2023, 3, 15, 13, 12, 0, 0, time.UTC),
+		"now/d-7d":                  time.Date(2023, 3, 8, 0, 0, 0, 0, time.UTC),
+		"now/M":                     time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC),
+		"start-of-last-month":       time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC),
+		"end-of-last-month":         time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC),
+		"end-of-last-month-1h":      time.Date(2023, 2, 28, 23, 0, 0, 0, time.UTC),
+	}
+	for expr, expected := range tcs {
+		t.Run(expr, func(t *testing.T) {
+			actual, err := timeexpr.Parse(expr, now)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+			require.Equal(t, time.UTC, actual.Location())
+		})
+	}
+}
+
+func TestParse_LastMonthInJanuary(t *testing.T) {
+	now := time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	start, err := timeexpr.Parse("start-of-last-month", now)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC), start)
+}
+
+func TestParseInLocation_NegativeOffset(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	// 02:00 UTC on the first of the month is still the previous month in New York.
+	now := time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC)
+
+	tcs := map[string]time.Time{
+		"start-of-last-month": time.Date(2026, 8, 1, 4, 0, 0, 0, time.UTC),
+		"end-of-last-month":   time.Date(2026, 9, 1, 4, 0, 0, 0, time.UTC),
+		"now/M":               time.Date(2026, 9, 1, 4, 0, 0, 0, time.UTC),
+		"now/d":               time.Date(2026, 9, 30, 4, 0, 0, 0, time.UTC),
+		"now/h":               time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC),
+	}
+	for expr, expected := range tcs {
+		t.Run(expr, func(t *testing.T) {
+			actual, err := timeexpr.ParseInLocation(expr, now, newYork)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+			require.Equal(t, time.UTC, actual.Location())
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	now := time.Date(2023, 3, 15, 13, 42, 7, 0, time.UTC)
+
+	for _, expr := range []string{"", "yesterday", "now-", "now-3x", "now/w", "now*2", "2023-07-08"} {
+		_, err := timeexpr.Parse(expr, now)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestIsAbsolute(t *testing.T) {
+	require.True(t, timeexpr.IsAbsolute("2023-07-08T13:00:00Z"))
+	require.False(t, timeexpr.IsAbsolute("now/h"))
+}
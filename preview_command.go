@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+type previewCommand struct {
+	PrometheusURL string
+
+	ReportArgs report.ReportArgs
+	SalesOrder salesOrderFlags
+	Jsonnet    jsonnetFlags
+	Alignment  alignmentFlags
+
+	BeginExpr string
+	Begin     *time.Time
+
+	PromQueryTimeout            time.Duration
+	ThanosAllowPartialResponses bool
+	OrgId                       string
+}
+
+var previewCommandName = "preview"
+
+func newPreviewCommand() *cli.Command {
+	command := &previewCommand{}
+	return &cli.Command{
+		Name:   previewCommandName,
+		Usage:  "Show the invoice lines a report would create for a single timerange without contacting Odoo",
+		Before: command.before,
+		Action: command.execute,
+		Flags: slices.Concat([]cli.Flag{
+			newPromURLFlag(&command.PrometheusURL),
+			&cli.StringFlag{Name: "product-id", Usage: "Odoo Product ID for this query",
+				EnvVars: envVars("PRODUCT_ID"), Destination: &command.ReportArgs.ProductID, DefaultText: defaultTextForOptionalFlags},
+			newProductIDJsonnetFlag(&command.ReportArgs.ProductIDJsonnet),
+			&cli.StringFlag{Name: "query", Usage: "Prometheus query to run",
+				EnvVars: envVars("QUERY"), Destination: &command.ReportArgs.Query, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "instance-jsonnet", Usage: "Jsonnet snippet that generates the Instance ID. Required unless --instance-jsonnet-file is set.",
+				EnvVars: envVars("INSTANCE_JSONNET"), Destination: &command.ReportArgs.InstanceJsonnet, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "item-group-description-jsonnet", Usage: "Jsonnet snippet that generates the item group description on invoice",
+				EnvVars: envVars("ITEM_GROUP_DESCRIPTION_JSONNET"), Destination: &command.ReportArgs.ItemGroupDescriptionJsonnet, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "item-description-jsonnet", Usage: "Jsonnet snippet that generates the item description on invoice",
+				EnvVars: envVars("ITEM_DESCRIPTION_JSONNET"), Destination: &command.ReportArgs.ItemDescriptionJsonnet, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "unit-id", Usage: "ID of the unit to use in Odoo",
+				EnvVars: envVars("UNIT_ID"), Destination: &command.ReportArgs.UnitID, DefaultText: defaultTextForOptionalFlags},
+			newUnitIDJsonnetFlag(&command.ReportArgs.UnitIDJsonnet),
+			&cli.StringFlag{Name: "begin", Usage: "Beginning timestamp of the timerange to preview " + timeExpressionUsage,
+				EnvVars: envVars("BEGIN"), Destination: &command.BeginExpr, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.DurationFlag{Name: "timerange", Usage: "Timerange for individual measurement samples. Ignored if --alignment is month.",
+				EnvVars: envVars("TIMERANGE"), Destination: &command.ReportArgs.TimerangeSize, Value: time.Hour},
+			&cli.DurationFlag{Name: "prom-query-timeout", Usage: "Timeout when querying prometheus (example: 1m)",
+				EnvVars: envVars("PROM_QUERY_TIMEOUT"), Destination: &command.PromQueryTimeout},
+			&cli.BoolFlag{Name: "thanos-allow-partial-responses", Usage: "Allows partial responses from Thanos. Can be helpful when querying a Thanos cluster with lost data.",
+				EnvVars: envVars("THANOS_ALLOW_PARTIAL_RESPONSES"), Destination: &command.ThanosAllowPartialResponses, DefaultText: "false"},
+			&cli.StringFlag{Name: "org-id", Usage: "Sets the X-Scope-OrgID header to this value on requests to Prometheus", Value: "",
+				EnvVars: envVars("ORG_ID"), Destination: &command.OrgId, DefaultText: "empty"},
+		}, command.SalesOrder.flags(), command.Jsonnet.flags(), command.Alignment.flags()),
+	}
+}
+
+func (cmd *previewCommand) before(context *cli.Context) error {
+	if err := cmd.Alignment.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	begin, err := parseTimeFlag("begin", cmd.BeginExpr, time.Now(), cmd.ReportArgs)
+	if err != nil {
+		return err
+	}
+	if err := cmd.ReportArgs.CheckAlignment(*begin); err != nil {
+		return fmt.Errorf("invalid --begin: %w", err)
+	}
+	cmd.Begin = begin
+	if err := cmd.SalesOrder.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := cmd.Jsonnet.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := requireInstanceJsonnet(cmd.ReportArgs); err != nil {
+		return err
+	}
+	return LogMetadata(context)
+}
+
+func (cmd *previewCommand) execute(cliCtx *cli.Context) error {
+	ctx := cliCtx.Context
+
+	promClient, err := newPrometheusAPIClient(cmd.PrometheusURL, cmd.ThanosAllowPartialResponses, cmd.OrgId)
+	if err != nil {
+		return fmt.Errorf("could not create prometheus client: %w", err)
+	}
+
+	o := make([]report.Option, 0)
+	if cmd.PromQueryTimeout != 0 {
+		o = append(o, report.WithPrometheusQueryTimeout(cmd.PromQueryTimeout))
+	}
+	records, err := report.Records(ctx, promClient, cmd.ReportArgs, *cmd.Begin, o...)
+	if records == nil && err != nil {
+		return err
+	}
+
+	if perr := renderPreview(cliCtx.App.Writer, cmd.ReportArgs, *cmd.Begin, records); perr != nil {
+		return perr
+	}
+	if err != nil {
+		for _, e := range multierr.Errors(err) {
+			fmt.Fprintf(cliCtx.App.ErrWriter, "%s\n", e)
+		}
+		return fmt.Errorf("%d samples could not be processed", len(multierr.Errors(err)))
+	}
+	return nil
+}
+
+// renderPreview writes the records as a table grouped by sales order, product and unit, with the total consumed units of each group.
+// The grand total of the consumed units is only written if all records have the same unit.
+func renderPreview(out io.Writer, args report.ReportArgs, begin time.Time, records []odoo.OdooMeteredBillingRecord) error {
+	fmt.Fprintf(out, "Timerange: %s - %s\n\n", begin.UTC().Format(time.RFC3339), args.TimerangeEnd(begin).Format(time.RFC3339))
+
+	sorted := append([]odoo.OdooMeteredBillingRecord{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].SalesOrderID != sorted[j].SalesOrderID {
+			return sorted[i].SalesOrderID < sorted[j].SalesOrderID
+		}
+		if sorted[i].ProductID != sorted[j].ProductID {
+			return sorted[i].ProductID < sorted[j].ProductID
+		}
+		if sorted[i].UnitID != sorted[j].UnitID {
+			return sorted[i].UnitID < sorted[j].UnitID
+		}
+		return sorted[i].InstanceID < sorted[j].InstanceID
+	})
+	sameGroup := func(a, b odoo.OdooMeteredBillingRecord) bool {
+		return a.SalesOrderID == b.SalesOrderID && a.ProductID == b.ProductID && a.UnitID == b.UnitID
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SALES ORDER\tPRODUCT\tUNIT\tINSTANCE ID\tITEM GROUP\tDESCRIPTION\tCONSUMED UNITS")
+	var total, groupTotal float64
+	units := map[string]bool{}
+	for i, r := range sorted {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.SalesOrderID, r.ProductID, r.UnitID, r.InstanceID, r.ItemGroupDescription, r.ItemDescription, formatUnits(r.ConsumedUnits))
+		total += r.ConsumedUnits
+		groupTotal += r.ConsumedUnits
+		units[r.UnitID] = true
+		if i == len(sorted)-1 || !sameGroup(sorted[i+1], r) {
+			fmt.Fprintf(w, "%s\t%s\t%s\tTotal\t\t\t%s\n", r.SalesOrderID, r.ProductID, r.UnitID, formatUnits(groupTotal))
+			groupTotal = 0
+		}
+	}
+	// Consumed units of different units can't be added up.
+	if len(units) > 1 {
+		fmt.Fprintf(w, "Total\t\t\t%d records\t\t\t\n", len(sorted))
+	} else {
+		fmt.Fprintf(w, "Total\t\t\t%d records\t\t\t%s\n", len(sorted), formatUnits(total))
+	}
+	return w.Flush()
+}
+
+func formatUnits(u float64) string {
+	return strconv.FormatFloat(u, 'f', -1, 64)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+func TestRenderPreview_GroupsByProductAndUnit(t *testing.T) {
+	begin := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	records := []odoo.OdooMeteredBillingRecord{
+		{SalesOrderID: "SO1", ProductID: "storage", UnitID: "GB", InstanceID: "b", ConsumedUnits: 2},
+		{SalesOrderID: "SO1", ProductID: "cpu", UnitID: "core", InstanceID: "a", ConsumedUnits: 3},
+		{SalesOrderID: "SO1", ProductID: "storage", UnitID: "GB", InstanceID: "a", ConsumedUnits: 1},
+	}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, renderPreview(out, report.ReportArgs{TimerangeSize: time.Hour}, begin, records))
+	require.Equal(t, `Timerange: 2024-03-01T00:00:00Z - 2024-03-01T01:00:00Z
+
+SALES ORDER  PRODUCT  UNIT  INSTANCE ID  ITEM GROUP  DESCRIPTION  CONSUMED UNITS
+SO1          cpu      core  a                                     3
+SO1          cpu      core  Total                                 3
+SO1          storage  GB    a                                     1
+SO1          storage  GB    b                                     2
+SO1          storage  GB    Total                                 3
+Total                       3 records                             
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, renderPreview(out, report.ReportArgs{TimerangeSize: time.Hour}, begin, records[:1]))
+	require.Contains(t, out.String(), "Total                       1 records                             2\n")
+}
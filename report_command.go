@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"slices"
 	"time"
 
+	"github.com/appuio/appuio-reporting/pkg/config"
 	"github.com/appuio/appuio-reporting/pkg/odoo"
 	"github.com/appuio/appuio-reporting/pkg/report"
 	"github.com/appuio/appuio-reporting/pkg/thanos"
@@ -20,10 +22,36 @@ type reportCommand struct {
 	OdooClientId      string
 	OdooClientSecret  string
 
+	OdooMaxRecordsPerRequest int
+	OdooMaxRequestBodySize   int
+
+	Sink    sinkFlags
+	Metrics metricsFlags
+	Retry   retryFlags
+
+	DryRun       bool
+	DryRunOutput string
+
+	Ledger ledgerFlags
+
+	CheckpointFile string
+	Resume         bool
+
+	ContinueOnError bool
+	Concurrency     int
+
+	SampleErrorPolicy    string
+	SampleErrorThreshold float64
+
 	ReportArgs report.ReportArgs
+	SalesOrder salesOrderFlags
+	Jsonnet    jsonnetFlags
+	Alignment  alignmentFlags
 
-	Begin       *time.Time
-	RepeatUntil *time.Time
+	BeginExpr       string
+	RepeatUntilExpr string
+	Begin           *time.Time
+	RepeatUntil     *time.Time
 
 	PromQueryTimeout            time.Duration
 	ThanosAllowPartialResponses bool
@@ -39,54 +67,115 @@ func newReportCommand() *cli.Command {
 		Usage:  "Run a report for a query in the given period",
 		Before: command.before,
 		Action: command.execute,
-		Flags: []cli.Flag{
+		Flags: slices.Concat([]cli.Flag{
 			&cli.StringFlag{Name: "prom-url", Usage: "Prometheus connection URL in the form of http://host:port",
 				EnvVars: envVars("PROM_URL"), Destination: &command.PrometheusURL, Value: "http://localhost:9090"},
 			&cli.StringFlag{Name: "odoo-url", Usage: "URL of the Odoo Metered Billing API",
 				EnvVars: envVars("ODOO_URL"), Destination: &command.OdooURL, Value: "http://localhost:8080"},
 			&cli.StringFlag{Name: "odoo-oauth-token-url", Usage: "Oauth Token URL to authenticate with Odoo metered billing API",
-				EnvVars: envVars("ODOO_OAUTH_TOKEN_URL"), Destination: &command.OdooOauthTokenURL, Required: true, DefaultText: defaultTextForRequiredFlags},
+				EnvVars: envVars("ODOO_OAUTH_TOKEN_URL"), Destination: &command.OdooOauthTokenURL, DefaultText: defaultTextForRequiredFlags},
 			&cli.StringFlag{Name: "odoo-oauth-client-id", Usage: "Client ID of the oauth client to interact with Odoo metered billing API",
-				EnvVars: envVars("ODOO_OAUTH_CLIENT_ID"), Destination: &command.OdooClientId, Required: true, DefaultText: defaultTextForRequiredFlags},
+				EnvVars: envVars("ODOO_OAUTH_CLIENT_ID"), Destination: &command.OdooClientId, DefaultText: defaultTextForRequiredFlags},
 			&cli.StringFlag{Name: "odoo-oauth-client-secret", Usage: "Client secret of the oauth client to interact with Odoo metered billing API",
-				EnvVars: envVars("ODOO_OAUTH_CLIENT_SECRET"), Destination: &command.OdooClientSecret, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.StringFlag{Name: "product-id", Usage: fmt.Sprintf("Odoo Product ID for this query"),
-				EnvVars: envVars("PRODUCT_ID"), Destination: &command.ReportArgs.ProductID, Required: true, DefaultText: defaultTextForRequiredFlags},
+				EnvVars: envVars("ODOO_OAUTH_CLIENT_SECRET"), Destination: &command.OdooClientSecret, DefaultText: defaultTextForRequiredFlags},
+			newOdooMaxRecordsPerRequestFlag(&command.OdooMaxRecordsPerRequest),
+			newOdooMaxRequestBodySizeFlag(&command.OdooMaxRequestBodySize),
+			&cli.StringFlag{Name: "product-id", Usage: fmt.Sprintf("Odoo Product ID for this query. Required unless --product-id-jsonnet is set."),
+				EnvVars: envVars("PRODUCT_ID"), Destination: &command.ReportArgs.ProductID, Required: false, DefaultText: defaultTextForRequiredFlags},
+			newProductIDJsonnetFlag(&command.ReportArgs.ProductIDJsonnet),
 			&cli.StringFlag{Name: "query", Usage: fmt.Sprintf("Prometheus query to run"),
 				EnvVars: envVars("QUERY"), Destination: &command.ReportArgs.Query, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.StringFlag{Name: "instance-jsonnet", Usage: fmt.Sprintf("Jsonnet snippet that generates the Instance ID"),
-				EnvVars: envVars("INSTANCE_JSONNET"), Destination: &command.ReportArgs.InstanceJsonnet, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "instance-jsonnet", Usage: fmt.Sprintf("Jsonnet snippet that generates the Instance ID. Required unless --instance-jsonnet-file is set."),
+				EnvVars: envVars("INSTANCE_JSONNET"), Destination: &command.ReportArgs.InstanceJsonnet, Required: false, DefaultText: defaultTextForRequiredFlags},
 			&cli.StringFlag{Name: "item-group-description-jsonnet", Usage: fmt.Sprintf("Jsonnet snippet that generates the item group description on invoice"),
 				EnvVars: envVars("ITEM_GROUP_DESCRIPTION_JSONNET"), Destination: &command.ReportArgs.ItemGroupDescriptionJsonnet, Required: false, DefaultText: defaultTextForOptionalFlags},
 			&cli.StringFlag{Name: "item-description-jsonnet", Usage: fmt.Sprintf("Jsonnet snippet that generates the item description on invoice"),
 				EnvVars: envVars("ITEM_DESCRIPTION_JSONNET"), Destination: &command.ReportArgs.ItemDescriptionJsonnet, Required: false, DefaultText: defaultTextForOptionalFlags},
-			&cli.StringFlag{Name: "unit-id", Usage: fmt.Sprintf("ID of the unit to use in Odoo"),
-				EnvVars: envVars("UNIT_ID"), Destination: &command.ReportArgs.UnitID, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.TimestampFlag{Name: "begin", Usage: fmt.Sprintf("Beginning timestamp of the report period in the form of RFC3339 (%s)", time.RFC3339),
-				EnvVars: envVars("BEGIN"), Layout: time.RFC3339, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.DurationFlag{Name: "timerange", Usage: "Timerange for individual measurement samples",
-				EnvVars: envVars("TIMERANGE"), Destination: &command.ReportArgs.TimerangeSize, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.TimestampFlag{Name: "repeat-until", Usage: fmt.Sprintf("Repeat running the report until reaching this timestamp (%s)", time.RFC3339),
-				EnvVars: envVars("REPEAT_UNTIL"), Layout: time.RFC3339, Required: false},
+			&cli.StringFlag{Name: "unit-id", Usage: fmt.Sprintf("ID of the unit to use in Odoo. Required unless --unit-id-jsonnet is set."),
+				EnvVars: envVars("UNIT_ID"), Destination: &command.ReportArgs.UnitID, Required: false, DefaultText: defaultTextForRequiredFlags},
+			newUnitIDJsonnetFlag(&command.ReportArgs.UnitIDJsonnet),
+			&cli.StringFlag{Name: "begin", Usage: "Beginning timestamp of the report period " + timeExpressionUsage,
+				EnvVars: envVars("BEGIN"), Destination: &command.BeginExpr, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.DurationFlag{Name: "timerange", Usage: "Timerange for individual measurement samples. Required unless --alignment is month.",
+				EnvVars: envVars("TIMERANGE"), Destination: &command.ReportArgs.TimerangeSize, Required: false, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringFlag{Name: "repeat-until", Usage: "Repeat running the report until reaching this timestamp " + timeExpressionUsage,
+				EnvVars: envVars("REPEAT_UNTIL"), Destination: &command.RepeatUntilExpr, Required: false, DefaultText: defaultTextForOptionalFlags},
 			&cli.DurationFlag{Name: "prom-query-timeout", Usage: "Timeout when querying prometheus (example: 1m)",
 				EnvVars: envVars("PROM_QUERY_TIMEOUT"), Destination: &command.PromQueryTimeout, Required: false},
 			&cli.BoolFlag{Name: "thanos-allow-partial-responses", Usage: "Allows partial responses from Thanos. Can be helpful when querying a Thanos cluster with lost data.",
 				EnvVars: envVars("THANOS_ALLOW_PARTIAL_RESPONSES"), Destination: &command.ThanosAllowPartialResponses, Required: false, DefaultText: "false"},
 			&cli.StringFlag{Name: "org-id", Usage: "Sets the X-Scope-OrgID header to this value on requests to Prometheus", Value: "",
 				EnvVars: envVars("ORG_ID"), Destination: &command.OrgId, Required: false, DefaultText: "empty"},
-			&cli.StringFlag{Name: "debug-override-sales-order-id", Usage: "Overrides the sales order ID to a static constant for debugging purposes", Value: "",
-				EnvVars: envVars("DEBUG_OVERRIDE_SALES_ORDER_ID"), Destination: &command.ReportArgs.OverrideSalesOrderID, Required: false, DefaultText: "empty"},
-		},
+			&cli.StringFlag{Name: "checkpoint-file", Usage: "Path to a file the last fully delivered timestamp is written to after each report. Requires --repeat-until, can not be used with --dry-run.",
+				EnvVars: envVars("CHECKPOINT_FILE"), Destination: &command.CheckpointFile, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.BoolFlag{Name: "resume", Usage: "Start after the timestamp in --checkpoint-file instead of --begin. Starts at --begin if the checkpoint file does not exist.",
+				EnvVars: envVars("RESUME"), Destination: &command.Resume, Required: false, DefaultText: "false"},
+			newContinueOnErrorFlag(&command.ContinueOnError),
+			newConcurrencyFlag(&command.Concurrency),
+			newSampleErrorPolicyFlag(&command.SampleErrorPolicy),
+			newSampleErrorThresholdFlag(&command.SampleErrorThreshold),
+			&cli.BoolFlag{Name: "dry-run", Usage: "Runs the report without sending any records to Odoo. The request bodies are written to --dry-run-output instead. The Odoo flags are not required in this mode, webhook sinks can not be used.",
+				EnvVars: envVars("DRY_RUN"), Destination: &command.DryRun, Required: false, DefaultText: "false"},
+			&cli.StringFlag{Name: "dry-run-output", Usage: "File to write the request bodies to in dry-run mode, one JSON request body per line. Use '-' for stdout.", Value: "-",
+				EnvVars: envVars("DRY_RUN_OUTPUT"), Destination: &command.DryRunOutput, Required: false},
+		}, command.SalesOrder.flags(), command.Jsonnet.flags(), command.Alignment.flags(), command.Retry.odooFlags(), command.Retry.promFlags(), command.Sink.flags(), command.Ledger.flags(), command.Metrics.flags()),
 	}
 }
 
 func (cmd *reportCommand) before(context *cli.Context) error {
-	cmd.Begin = context.Timestamp("begin")
-	cmd.RepeatUntil = context.Timestamp("repeat-until")
+	if err := cmd.Alignment.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	now := time.Now()
+	var err error
+	if cmd.Begin, err = parseTimeFlag("begin", cmd.BeginExpr, now, cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := cmd.ReportArgs.CheckAlignment(*cmd.Begin); err != nil {
+		return fmt.Errorf("invalid --begin: %w", err)
+	}
+	if cmd.RepeatUntil, err = parseTimeFlag("repeat-until", cmd.RepeatUntilExpr, now, cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := cmd.SalesOrder.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := cmd.Jsonnet.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := requireInstanceJsonnet(cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := requireIDFlags(context, cmd.ReportArgs); err != nil {
+		return err
+	}
+	if cmd.CheckpointFile != "" && cmd.RepeatUntil == nil {
+		return fmt.Errorf("--checkpoint-file requires --repeat-until")
+	}
+	if cmd.Resume && cmd.CheckpointFile == "" {
+		return fmt.Errorf("--resume requires --checkpoint-file")
+	}
+	if cmd.DryRun && cmd.CheckpointFile != "" {
+		return fmt.Errorf("--checkpoint-file can not be used with --dry-run, the checkpoint would advance without delivering any records")
+	}
+	if cmd.DryRun && cmd.Ledger.File != "" {
+		return fmt.Errorf("--ledger can not be used with --dry-run, records would be recorded as delivered")
+	}
+	if cmd.DryRun && cmd.Sink.usesWebhook() {
+		return fmt.Errorf("webhook sinks can not be used with --dry-run, records would be sent to the webhook")
+	}
+	if err := cmd.Ledger.checkBegin(*cmd.Begin, now); err != nil {
+		return fmt.Errorf("invalid --begin: %w", err)
+	}
+	if !cmd.DryRun && cmd.Sink.usesOdoo() {
+		if err := requireFlags(context, "odoo-oauth-token-url", "odoo-oauth-client-id", "odoo-oauth-client-secret"); err != nil {
+			return err
+		}
+	}
 	return LogMetadata(context)
 }
 
-func (cmd *reportCommand) execute(cliCtx *cli.Context) error {
+func (cmd *reportCommand) execute(cliCtx *cli.Context) (err error) {
 	ctx := cliCtx.Context
 	log := AppLogger(ctx).WithName(reportCommandName)
 
@@ -95,56 +184,151 @@ func (cmd *reportCommand) execute(cliCtx *cli.Context) error {
 		return fmt.Errorf("could not create prometheus client: %w", err)
 	}
 
-	odooClient := odoo.NewOdooAPIClient(ctx, cmd.OdooURL, cmd.OdooOauthTokenURL, cmd.OdooClientId, cmd.OdooClientSecret, log)
+	grouping := map[string]string{}
+	if cmd.ReportArgs.ProductID != "" {
+		grouping["product"] = cmd.ReportArgs.ProductID
+	}
+	m, stopMetrics, err := cmd.Metrics.start(log, grouping)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	// All Odoo sinks share the dry-run client, so that concurrent writes to the output are serialized.
+	var dryRunClient *odoo.DryRunClient
+	if cmd.DryRun && cmd.Sink.usesOdoo() {
+		out, closeOut, openErr := openOutput(cmd.DryRunOutput)
+		if openErr != nil {
+			return fmt.Errorf("could not open dry-run output: %w", openErr)
+		}
+		defer closeOutput("dry-run output", closeOut, &err)
+		dryRunClient = odoo.NewDryRunClient(out, log,
+			odoo.WithMaxRecordsPerRequest(cmd.OdooMaxRecordsPerRequest),
+			odoo.WithMaxRequestBodySize(cmd.OdooMaxRequestBodySize),
+		)
+	}
 
-	o := make([]report.Option, 0)
+	l, err := cmd.Ledger.open()
+	if err != nil {
+		return err
+	}
+	defaults := config.Odoo{
+		URL:                  cmd.OdooURL,
+		OauthTokenURL:        cmd.OdooOauthTokenURL,
+		OauthClientID:        cmd.OdooClientId,
+		OauthClientSecret:    cmd.OdooClientSecret,
+		MaxRecordsPerRequest: cmd.OdooMaxRecordsPerRequest,
+		MaxRequestBodySize:   cmd.OdooMaxRequestBodySize,
+	}
+	odooClient, closeSinks, err := cmd.Sink.newSink(log, l, cmd.ReportArgs.JsonnetLibraryPaths, cmd.ReportArgs.JsonnetExtVars, func(endpoint config.Odoo) report.OdooClient {
+		if cmd.DryRun {
+			return dryRunClient
+		}
+		e := endpoint.WithDefaults(defaults)
+		return odoo.NewOdooAPIClient(ctx, e.URL, e.OauthTokenURL, e.OauthClientID, e.OauthClientSecret, log,
+			cmd.Retry.odooOption(),
+			odoo.WithMaxRecordsPerRequest(e.MaxRecordsPerRequest),
+			odoo.WithMaxRequestBodySize(e.MaxRequestBodySize),
+			odoo.WithMetrics(m),
+		)
+	})
+	defer closeOutput("sinks", closeSinks, &err)
+	if err != nil {
+		return err
+	}
+
+	o := cmd.Retry.promOptions(log.WithValues("product", cmd.ReportArgs.ProductID))
 	if cmd.PromQueryTimeout != 0 {
 		o = append(o, report.WithPrometheusQueryTimeout(cmd.PromQueryTimeout))
 	}
+	o = append(o,
+		newSampleErrorReporter(log.WithValues("product", cmd.ReportArgs.ProductID)),
+		report.WithMetrics(m),
+	)
+	sampleErrorOptions, err := newSampleErrorOptions(cmd.SampleErrorPolicy, cmd.SampleErrorThreshold)
+	if err != nil {
+		return err
+	}
+	o = append(o, sampleErrorOptions...)
 
-	if cmd.RepeatUntil != nil {
-		if err := cmd.runReportRange(ctx, odooClient, promClient, o); err != nil {
+	if cmd.ContinueOnError {
+		o = append(o, report.WithContinueOnError())
+	}
+	if cmd.Concurrency > 1 {
+		o = append(o, report.WithConcurrency(cmd.Concurrency))
+	}
+
+	begin := *cmd.Begin
+	if cmd.CheckpointFile != "" {
+		o = append(o, report.WithCheckpointFile(cmd.CheckpointFile))
+	}
+	if cmd.Resume {
+		begin, err = report.ResumeFrom(cmd.CheckpointFile, cmd.ReportArgs, begin)
+		if err != nil {
 			return err
 		}
-	} else {
-		if err := cmd.runReport(ctx, odooClient, promClient, o); err != nil {
-			return err
+		log.Info("Resuming report range", "checkpointFile", cmd.CheckpointFile, "begin", begin.Format(time.RFC3339))
+		if !cmd.RepeatUntil.After(begin) {
+			log.Info("Nothing to do, checkpoint already reached --repeat-until")
+			return nil
 		}
 	}
 
+	if err := runReport(ctx, odooClient, promClient, cmd.ReportArgs, begin, cmd.RepeatUntil, o); err != nil {
+		return err
+	}
+
 	log.Info("Done")
 	return nil
 }
 
-func (cmd *reportCommand) runReportRange(ctx context.Context, odooClient *odoo.OdooAPIClient, promClient apiv1.API, o []report.Option) error {
+// runReport runs the report at begin or, if repeatUntil is set, for the range up to repeatUntil.
+func runReport(ctx context.Context, odooClient report.OdooClient, promClient apiv1.API, args report.ReportArgs, begin time.Time, repeatUntil *time.Time, o []report.Option) error {
+	if repeatUntil != nil {
+		return runReportRange(ctx, odooClient, promClient, args, begin, *repeatUntil, o)
+	}
+	log := AppLogger(ctx)
+
+	log.V(1).Info("Begin transaction")
+
+	log.Info("Running report...", "product", args.ProductID)
+	if err := report.Run(ctx, odooClient, promClient, args, begin, o...); err != nil {
+		return err
+	}
+	return nil
+}
+
+func runReportRange(ctx context.Context, odooClient report.OdooClient, promClient apiv1.API, args report.ReportArgs, begin time.Time, repeatUntil time.Time, o []report.Option) error {
 	log := AppLogger(ctx)
 
 	started := time.Now()
 	reporter := report.WithProgressReporter(func(p report.Progress) {
 		log.Info("Progress report",
-			"product", cmd.ReportArgs.ProductID,
+			"product", args.ProductID,
 			"reportIndex", p.Count,
 			"timestamp", p.Timestamp.Format(time.RFC3339),
+			"attempts", p.Attempts,
 			"timeElapsed", time.Since(started).Round(time.Second),
 		)
 	})
 
-	log.Info("Running reports...")
-	c, err := report.RunRange(ctx, odooClient, promClient, cmd.ReportArgs, *cmd.Begin, *cmd.RepeatUntil, append(o, reporter)...)
-	log.Info(fmt.Sprintf("Ran %d reports", c))
-	return err
-}
-
-func (cmd *reportCommand) runReport(ctx context.Context, odooClient *odoo.OdooAPIClient, promClient apiv1.API, o []report.Option) error {
-	log := AppLogger(ctx)
-
-	log.V(1).Info("Begin transaction")
-
-	log.Info("Running report...")
-	if err := report.Run(ctx, odooClient, promClient, cmd.ReportArgs, *cmd.Begin, o...); err != nil {
-		return err
+	log.Info("Running reports...", "product", args.ProductID)
+	s, err := report.RunRangeWithSummary(ctx, odooClient, promClient, args, begin, repeatUntil, append(o, reporter)...)
+	log.Info(fmt.Sprintf("Ran %d reports", s.Count()), "product", args.ProductID,
+		"succeeded", len(s.Succeeded),
+		"failed", len(s.Failed),
+		"skipped", len(s.Skipped),
+	)
+	for _, f := range s.Failed {
+		log.Error(f.Err, "Failed report", "product", args.ProductID, "timestamp", f.Timestamp.Format(time.RFC3339))
 	}
-	return nil
+	if len(s.Skipped) > 0 {
+		log.Info("Skipped reports", "product", args.ProductID,
+			"first", s.Skipped[0].Format(time.RFC3339),
+			"last", s.Skipped[len(s.Skipped)-1].Format(time.RFC3339),
+		)
+	}
+	return err
 }
 
 func newPrometheusAPIClient(promURL string, thanosAllowPartialResponses bool, orgId string) (apiv1.API, error) {
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/appuio/appuio-reporting/pkg/config"
+	"github.com/appuio/appuio-reporting/pkg/metrics"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+	"github.com/appuio/appuio-reporting/pkg/scheduler"
+)
+
+type serveCommand struct {
+	ConfigFile string
+	Reports    cli.StringSlice
+
+	OdooClientId     string
+	OdooClientSecret string
+
+	Sink  sinkFlags
+	Retry retryFlags
+
+	StateDir      string
+	Lag           time.Duration
+	RetryInterval time.Duration
+	ListenAddress string
+
+	Ledger      ledgerFlags
+	Concurrency int
+
+	SampleErrorPolicy    string
+	SampleErrorThreshold float64
+
+	JsonnetLibraryPaths cli.StringSlice
+	JsonnetExtVars      stringList
+
+	BeginExpr string
+	now       time.Time
+
+	config config.Config
+}
+
+var serveCommandName = "serve"
+
+func newServeCommand() *cli.Command {
+	command := &serveCommand{}
+	return &cli.Command{
+		Name:  serveCommandName,
+		Usage: "Run the reports defined in a configuration file continuously, each as soon as a timerange is complete",
+		Description: "Reports each timerange once it ended and --lag passed. The progress of each report is stored in --state-dir, " +
+			"so that timeranges missed during a downtime are caught up after a restart. " +
+			"Serves /healthz, /readyz and /metrics on --listen-address. /readyz succeeds once all reports caught up.",
+		Before: command.before,
+		Action: command.execute,
+		Flags: slices.Concat([]cli.Flag{
+			&cli.StringFlag{Name: "config", Usage: "Path to the YAML or JSON file containing the connection settings and report definitions",
+				EnvVars: envVars("CONFIG"), Destination: &command.ConfigFile, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.StringSliceFlag{Name: "report", Usage: "Name of a report in the configuration file to run. Can be repeated. Runs all reports if not set.",
+				EnvVars: envVars("REPORTS"), Destination: &command.Reports, Required: false, DefaultText: "all"},
+			&cli.StringFlag{Name: "odoo-oauth-client-id", Usage: "Client ID of the oauth client to interact with Odoo metered billing API. Overrides the value from the configuration file.",
+				EnvVars: envVars("ODOO_OAUTH_CLIENT_ID"), Destination: &command.OdooClientId, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "odoo-oauth-client-secret", Usage: "Client secret of the oauth client to interact with Odoo metered billing API. Overrides the value from the configuration file.",
+				EnvVars: envVars("ODOO_OAUTH_CLIENT_SECRET"), Destination: &command.OdooClientSecret, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "state-dir", Usage: "Directory the checkpoints of the reports are stored in",
+				EnvVars: envVars("STATE_DIR"), Destination: &command.StateDir, Required: true, DefaultText: defaultTextForRequiredFlags},
+			&cli.DurationFlag{Name: "lag", Usage: "Time to wait after the end of a timerange before reporting it, to account for ingestion delays. Can be overridden per report with 'lag' in the configuration file.",
+				EnvVars: envVars("LAG"), Destination: &command.Lag, Value: 10 * time.Minute},
+			&cli.DurationFlag{Name: "retry-interval", Usage: "Time to wait before retrying a failed report",
+				EnvVars: envVars("RETRY_INTERVAL"), Destination: &command.RetryInterval, Value: 5 * time.Minute},
+			&cli.StringFlag{Name: "begin", Usage: "Beginning timestamp for reports without checkpoint " + timeExpressionUsage + ". Defaults to the last complete timerange.",
+				EnvVars: envVars("BEGIN"), Destination: &command.BeginExpr, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "listen-address", Usage: "Address to serve the health, readiness and metrics endpoints on",
+				EnvVars: envVars("LISTEN_ADDRESS"), Destination: &command.ListenAddress, Value: ":8080"},
+			newConcurrencyFlag(&command.Concurrency),
+			newSampleErrorPolicyFlag(&command.SampleErrorPolicy),
+			newSampleErrorThresholdFlag(&command.SampleErrorThreshold),
+			newJsonnetLibPathFlag(&command.JsonnetLibraryPaths),
+			newJsonnetExtVarFlag(&command.JsonnetExtVars),
+		}, command.Retry.odooFlags(), command.Retry.promFlags(), command.Sink.flags(), command.Ledger.flags()),
+	}
+}
+
+func (cmd *serveCommand) before(context *cli.Context) error {
+	cmd.now = time.Now()
+	if _, err := parseTimeFlag("begin", cmd.BeginExpr, cmd.now, report.ReportArgs{}); err != nil {
+		return err
+	}
+
+	c, err := loadConfig(cmd.ConfigFile, cmd.OdooClientId, cmd.OdooClientSecret, cmd.Sink.usesOdoo())
+	if err != nil {
+		return err
+	}
+	cmd.config = c
+	return LogMetadata(context)
+}
+
+func (cmd *serveCommand) execute(cliCtx *cli.Context) (err error) {
+	ctx := cliCtx.Context
+	log := AppLogger(ctx).WithName(serveCommandName)
+
+	reports, err := cmd.config.Select(cmd.Reports.Value()...)
+	if err != nil {
+		return err
+	}
+	extVars, err := parseJsonnetExtVars(cmd.JsonnetExtVars.Value())
+	if err != nil {
+		return err
+	}
+	libraryPaths := slices.Concat(cmd.config.JsonnetLibraryPaths, cmd.JsonnetLibraryPaths.Value())
+
+	m := metrics.New()
+	registry := prometheus.NewRegistry()
+	if err := m.Register(registry); err != nil {
+		return err
+	}
+
+	promClient, err := newPrometheusAPIClient(cmd.config.Prometheus.URL, cmd.config.Prometheus.ThanosAllowPartialResponses, cmd.config.Prometheus.OrgID)
+	if err != nil {
+		return fmt.Errorf("could not create prometheus client: %w", err)
+	}
+
+	l, err := cmd.Ledger.open()
+	if err != nil {
+		return err
+	}
+	odooClient, closeSinks, err := cmd.Sink.newSink(log, l, libraryPaths, extVars, func(endpoint config.Odoo) report.OdooClient {
+		o := endpoint.WithDefaults(cmd.config.Odoo)
+		return odoo.NewOdooAPIClient(ctx, o.URL, o.OauthTokenURL, o.OauthClientID, o.OauthClientSecret, log,
+			cmd.Retry.odooOption(),
+			odoo.WithMaxRecordsPerRequest(o.MaxRecordsPerRequest),
+			odoo.WithMaxRequestBodySize(o.MaxRequestBodySize),
+			odoo.WithMetrics(m),
+		)
+	})
+	defer closeOutput("sinks", closeSinks, &err)
+	if err != nil {
+		return err
+	}
+
+	o := []report.Option{report.WithMetrics(m)}
+	if cmd.config.Prometheus.QueryTimeout != 0 {
+		o = append(o, report.WithPrometheusQueryTimeout(cmd.config.Prometheus.QueryTimeout))
+	}
+	if cmd.Concurrency > 1 {
+		o = append(o, report.WithConcurrency(cmd.Concurrency))
+	}
+	sampleErrorOptions, err := newSampleErrorOptions(cmd.SampleErrorPolicy, cmd.SampleErrorThreshold)
+	if err != nil {
+		return err
+	}
+	o = append(o, sampleErrorOptions...)
+
+	jobs := make([]scheduler.Job, 0, len(reports))
+	for _, r := range reports {
+		args := r.ReportArgs()
+		args.JsonnetLibraryPaths = libraryPaths
+		args.JsonnetExtVars = mergeJsonnetExtVars(args.JsonnetExtVars, extVars)
+		job := scheduler.Job{Name: r.Name, Args: args, Lag: cmd.Lag}
+		if r.Lag != 0 {
+			job.Lag = r.Lag
+		}
+		if begin, _ := parseTimeFlag("begin", cmd.BeginExpr, cmd.now, args); begin != nil {
+			if err := cmd.Ledger.checkBegin(*begin, cmd.now); err != nil {
+				return fmt.Errorf("report %q: invalid --begin: %w", r.Name, err)
+			}
+			job.Begin = *begin
+		}
+		jobs = append(jobs, job)
+	}
+
+	s := scheduler.New(cmd.StateDir, jobs, func(ctx context.Context, job scheduler.Job, from, until time.Time, checkpointFile string) error {
+		jlog := log.WithValues("report", job.Name)
+		ro := slices.Concat(o, cmd.Retry.promOptions(jlog), []report.Option{report.WithCheckpointFile(checkpointFile), newSampleErrorReporter(jlog)})
+		return runReportRange(ctx, odooClient, promClient, job.Args, from, until, ro)
+	}, log, scheduler.WithRetryInterval(cmd.RetryInterval))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetricsHandler(registry))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !s.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(s.Status())
+	})
+	stopServer, err := listenAndServe(log, cmd.ListenAddress, mux)
+	if err != nil {
+		return err
+	}
+	defer stopServer()
+
+	log.Info("Running reports continuously", "reports", len(jobs), "stateDir", cmd.StateDir)
+	if err := s.Run(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	log.Info("Stopped")
+	return nil
+}
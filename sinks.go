@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/config"
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+	"github.com/appuio/appuio-reporting/pkg/report"
+	"github.com/appuio/appuio-reporting/pkg/sink"
+)
+
+const odooSinkName = "odoo"
+
+// sinkFlags holds the flags to configure where records are delivered to.
+type sinkFlags struct {
+	Sinks             cli.StringSlice
+	SinkMode          string
+	OdooEndpointsFile string
+	CSVColumns        cli.StringSlice
+	CSVHeader         bool
+
+	WebhookMethod            string
+	WebhookHeaders           stringList
+	WebhookBearerToken       string
+	WebhookBasicAuthUsername string
+	WebhookBasicAuthPassword string
+	WebhookBodyJsonnet       string
+	WebhookSuccessStatus     cli.IntSlice
+	WebhookTimeout           time.Duration
+}
+
+func (f *sinkFlags) flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{Name: "sink", Usage: "Where to deliver the records to. Can be repeated to deliver the records to multiple sinks. " +
+			"Values: 'odoo', 'odoo=<url>', 'csv=<path>', 'jsonl=<path>', 'webhook=<url>'. 'odoo=<url>' delivers to another Odoo endpoint, see --odoo-endpoints-file. Records are appended to existing files. Use '-' as path for stdout.",
+			EnvVars: envVars("SINKS"), Destination: &f.Sinks, Value: cli.NewStringSlice(odooSinkName)},
+		&cli.StringFlag{Name: "odoo-endpoints-file", Usage: "Path to a YAML or JSON file containing a list of Odoo endpoints with the keys url, oauthTokenUrl, oauthClientId and oauthClientSecret. " +
+			"'odoo=<url>' sinks use the credentials of the endpoint with the same URL. Credentials left empty or of endpoints not in the file are taken from the Odoo settings.",
+			EnvVars: envVars("ODOO_ENDPOINTS_FILE"), Destination: &f.OdooEndpointsFile, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "sink-mode", Usage: fmt.Sprintf("How failures are handled if multiple sinks are configured. "+
+			"'%s' fails if any sink failed, '%s' logs a warning and only fails if all sinks failed.", sink.AllMustSucceed, sink.BestEffort),
+			EnvVars: envVars("SINK_MODE"), Destination: &f.SinkMode, Value: string(sink.AllMustSucceed)},
+		&cli.StringSliceFlag{Name: "csv-columns", Usage: fmt.Sprintf("Columns written by CSV sinks, in order. Available columns: %s", strings.Join(sink.DefaultCSVColumns, ", ")),
+			EnvVars: envVars("CSV_COLUMNS"), Destination: &f.CSVColumns, DefaultText: "all"},
+		&cli.BoolFlag{Name: "csv-header", Usage: "Write the column names as the first row of new files of CSV sinks",
+			EnvVars: envVars("CSV_HEADER"), Destination: &f.CSVHeader, Value: true},
+		&cli.StringFlag{Name: "webhook-method", Usage: "HTTP method used by webhook sinks",
+			EnvVars: envVars("WEBHOOK_METHOD"), Destination: &f.WebhookMethod, Value: http.MethodPost},
+		&cli.GenericFlag{Name: "webhook-header", Usage: "Header sent by webhook sinks, as 'Name: value'. The value can contain commas. Can be repeated.",
+			EnvVars: envVars("WEBHOOK_HEADERS"), Value: &f.WebhookHeaders, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "webhook-bearer-token", Usage: "Bearer token used by webhook sinks to authenticate",
+			EnvVars: envVars("WEBHOOK_BEARER_TOKEN"), Destination: &f.WebhookBearerToken, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "webhook-basic-auth-username", Usage: "Username used by webhook sinks to authenticate using HTTP basic authentication",
+			EnvVars: envVars("WEBHOOK_BASIC_AUTH_USERNAME"), Destination: &f.WebhookBasicAuthUsername, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "webhook-basic-auth-password", Usage: "Password used by webhook sinks to authenticate using HTTP basic authentication",
+			EnvVars: envVars("WEBHOOK_BASIC_AUTH_PASSWORD"), Destination: &f.WebhookBasicAuthPassword, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "webhook-body-jsonnet", Usage: "Jsonnet template rendering the request body of webhook sinks. The records are available as `std.extVar(\"records\")`. Can import files from --jsonnet-lib-path and use the variables of --jsonnet-ext-var.",
+			EnvVars: envVars("WEBHOOK_BODY_JSONNET"), Destination: &f.WebhookBodyJsonnet, Value: sink.DefaultWebhookBodyJsonnet},
+		&cli.DurationFlag{Name: "webhook-timeout", Usage: "Timeout of the requests of webhook sinks, including reading the response. 0 means no timeout.",
+			EnvVars: envVars("WEBHOOK_TIMEOUT"), Destination: &f.WebhookTimeout, Value: sink.DefaultWebhookTimeout},
+		&cli.IntSliceFlag{Name: "webhook-success-status", Usage: "Status code considered a successful delivery by webhook sinks. Can be repeated.",
+			EnvVars: envVars("WEBHOOK_SUCCESS_STATUS"), Destination: &f.WebhookSuccessStatus, DefaultText: "any 2xx"},
+	}
+}
+
+// usesOdoo returns true if records are delivered to Odoo.
+func (f *sinkFlags) usesOdoo() bool {
+	return f.uses(odooSinkName)
+}
+
+// usesWebhook returns true if records are delivered to a webhook.
+func (f *sinkFlags) usesWebhook() bool {
+	return f.uses("webhook")
+}
+
+func (f *sinkFlags) uses(kind string) bool {
+	for _, s := range f.Sinks.Value() {
+		if k, _, _ := strings.Cut(s, "="); k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// newSink creates the configured sinks. newOdooClient is called to create the client for each 'odoo' sink.
+// The settings passed to newOdooClient are empty for the 'odoo' sink. For 'odoo=<url>' sinks they contain the URL and the settings of the endpoint in the endpoints file.
+// Empty settings are meant to be taken from the configured Odoo settings, see config.Odoo.WithDefaults.
+// If multiple sinks are configured, the records are delivered to all of them, failures are handled according to the sink mode.
+// If a ledger is given, each sink skips the records that have been delivered to it before and records the delivered ones, keyed by the sink.
+// Webhook body templates can import files from jsonnetLibraryPaths and use the external variables jsonnetExtVars.
+// The returned close function closes all opened files and has to be called even if an error is returned.
+func (f *sinkFlags) newSink(logger logr.Logger, l *ledger.FileLedger, jsonnetLibraryPaths []string, jsonnetExtVars map[string]string, newOdooClient func(endpoint config.Odoo) report.OdooClient) (report.OdooClient, func() error, error) {
+	var closers []func() error
+	closeAll := func() error {
+		var errs error
+		for _, c := range closers {
+			errs = multierr.Append(errs, c())
+		}
+		return errs
+	}
+
+	mode, err := sink.ParseMode(f.SinkMode)
+	if err != nil {
+		return nil, closeAll, err
+	}
+
+	endpoints := map[string]config.Odoo{}
+	if f.OdooEndpointsFile != "" {
+		if endpoints, err = config.LoadOdooEndpoints(f.OdooEndpointsFile); err != nil {
+			return nil, closeAll, err
+		}
+	}
+
+	sinks := make([]sink.Named, 0, len(f.Sinks.Value()))
+	for _, spec := range f.Sinks.Value() {
+		kind, path, hasPath := strings.Cut(spec, "=")
+		if kind != odooSinkName && path == "" {
+			if kind == "webhook" {
+				return nil, closeAll, fmt.Errorf("sink %q requires a URL, e.g. %s=https://example.com/usage", spec, kind)
+			}
+			return nil, closeAll, fmt.Errorf("sink %q requires a path, e.g. %s=records.%s", spec, kind, kind)
+		}
+		switch kind {
+		case odooSinkName:
+			if hasPath && path == "" {
+				return nil, closeAll, fmt.Errorf("sink %q requires a URL, e.g. %s=https://odoo.example.com", spec, kind)
+			}
+			endpoint := config.Odoo{}
+			if hasPath {
+				endpoint = endpoints[path]
+				endpoint.URL = path
+			}
+			sinks = append(sinks, sink.Named{Name: spec, Client: newOdooClient(endpoint)})
+		case "csv":
+			out, empty, closeOut, err := appendOutput(path)
+			if err != nil {
+				return nil, closeAll, fmt.Errorf("could not open output of sink %q: %w", spec, err)
+			}
+			closers = append(closers, closeOut)
+			// Records of previous runs are kept, the header is only written to new files.
+			s, err := sink.NewCSVSink(out, f.CSVColumns.Value(), f.CSVHeader && empty)
+			if err != nil {
+				return nil, closeAll, err
+			}
+			sinks = append(sinks, sink.Named{Name: spec, Client: s})
+		case "jsonl":
+			out, _, closeOut, err := appendOutput(path)
+			if err != nil {
+				return nil, closeAll, fmt.Errorf("could not open output of sink %q: %w", spec, err)
+			}
+			closers = append(closers, closeOut)
+			sinks = append(sinks, sink.Named{Name: spec, Client: sink.NewJSONLSink(out)})
+		case "webhook":
+			opts, err := f.webhookOptions(jsonnetLibraryPaths, jsonnetExtVars)
+			if err != nil {
+				return nil, closeAll, err
+			}
+			s, err := sink.NewWebhook(path, f.WebhookBodyJsonnet, opts...)
+			if err != nil {
+				return nil, closeAll, err
+			}
+			sinks = append(sinks, sink.Named{Name: spec, Client: s})
+		default:
+			return nil, closeAll, fmt.Errorf("unknown sink %q", spec)
+		}
+	}
+
+	if l != nil {
+		for i, s := range sinks {
+			sinks[i].Client = report.LedgerClient{Client: s.Client, Ledger: l.ForSink(s.Name)}
+		}
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, closeAll, fmt.Errorf("at least one sink is required")
+	case 1:
+		return sinks[0].Client, closeAll, nil
+	}
+	return sink.NewFanOut(mode, logger, sinks...), closeAll, nil
+}
+
+// webhookOptions returns the options of webhook sinks.
+func (f *sinkFlags) webhookOptions(jsonnetLibraryPaths []string, jsonnetExtVars map[string]string) ([]sink.WebhookOption, error) {
+	if f.WebhookTimeout < 0 {
+		return nil, fmt.Errorf("--webhook-timeout must not be negative, got %s", f.WebhookTimeout)
+	}
+	opts := []sink.WebhookOption{
+		sink.WithMethod(f.WebhookMethod),
+		sink.WithTimeout(f.WebhookTimeout),
+		sink.WithJsonnetLibraryPaths(jsonnetLibraryPaths...),
+		sink.WithJsonnetExtVars(jsonnetExtVars),
+	}
+	for _, h := range f.WebhookHeaders.Value() {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid webhook header %q, expected 'Name: value'", h)
+		}
+		opts = append(opts, sink.WithHeader(strings.TrimSpace(name), strings.TrimSpace(value)))
+	}
+	if f.WebhookBearerToken != "" && f.WebhookBasicAuthUsername != "" {
+		return nil, fmt.Errorf("only one of bearer token and basic authentication can be used for webhook sinks")
+	}
+	if f.WebhookBearerToken != "" {
+		opts = append(opts, sink.WithBearerToken(f.WebhookBearerToken))
+	}
+	if f.WebhookBasicAuthUsername != "" {
+		opts = append(opts, sink.WithBasicAuth(f.WebhookBasicAuthUsername, f.WebhookBasicAuthPassword))
+	}
+	if codes := f.WebhookSuccessStatus.Value(); len(codes) > 0 {
+		opts = append(opts, sink.WithSuccessStatusCodes(codes...))
+	}
+	return opts, nil
+}
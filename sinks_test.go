@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+
+	"github.com/appuio/appuio-reporting/pkg/config"
+	"github.com/appuio/appuio-reporting/pkg/ledger"
+	"github.com/appuio/appuio-reporting/pkg/odoo"
+	"github.com/appuio/appuio-reporting/pkg/report"
+	"github.com/appuio/appuio-reporting/pkg/sink"
+)
+
+func TestSinkFlags_AppendsToFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.csv")
+	f := &sinkFlags{SinkMode: string(sink.AllMustSucceed), CSVHeader: true}
+	require.NoError(t, f.Sinks.Set("csv="+path))
+
+	for _, from := range []time.Time{time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.March, 1, 1, 0, 0, 0, time.UTC)} {
+		s, closeSinks, err := f.newSink(logr.Discard(), nil, nil, nil, func(config.Odoo) report.OdooClient { return nil })
+		require.NoError(t, err)
+		require.NoError(t, s.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{
+			{ProductID: "p", InstanceID: "a", SalesOrderID: "SO1", Timerange: odoo.Timerange{From: from, To: from.Add(time.Hour)}},
+		}))
+		require.NoError(t, closeSinks())
+	}
+
+	out, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "product_id,instance_id,sales_order_id,unit_id,consumed_units,timerange_from,timerange_to,item_group_description,item_description\n"+
+		"p,a,SO1,,0,2024-03-01T00:00:00Z,2024-03-01T01:00:00Z,,\n"+
+		"p,a,SO1,,0,2024-03-01T01:00:00Z,2024-03-01T02:00:00Z,,\n", string(out))
+}
+
+func TestSinkFlags_OdooEndpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- url: https://other-odoo/api
+  oauthClientId: other-client
+  oauthClientSecret: other-secret
+`), 0o600))
+	f := &sinkFlags{SinkMode: string(sink.AllMustSucceed), OdooEndpointsFile: path}
+	require.NoError(t, f.Sinks.Set("odoo"))
+	require.NoError(t, f.Sinks.Set("odoo=https://other-odoo/api"))
+	require.NoError(t, f.Sinks.Set("odoo=https://odoo/v2/api"))
+
+	endpoints := make([]config.Odoo, 0)
+	_, closeSinks, err := f.newSink(logr.Discard(), nil, nil, nil, func(e config.Odoo) report.OdooClient {
+		endpoints = append(endpoints, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, closeSinks())
+	require.Equal(t, []config.Odoo{
+		{},
+		{URL: "https://other-odoo/api", OauthClientID: "other-client", OauthClientSecret: "other-secret"},
+		{URL: "https://odoo/v2/api"},
+	}, endpoints)
+}
+
+func TestSinkFlags_WebhookHeaderWithComma(t *testing.T) {
+	var accept []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Values("Accept")
+	}))
+	defer srv.Close()
+
+	f := &sinkFlags{}
+	app := &cli.App{Flags: f.flags(), Action: func(*cli.Context) error { return nil }}
+	require.NoError(t, app.Run([]string{"test", "--sink", "webhook=" + srv.URL, "--webhook-header", "Accept: application/json, text/plain"}))
+
+	s, closeSinks, err := f.newSink(logr.Discard(), nil, nil, nil, func(config.Odoo) report.OdooClient { return nil })
+	require.NoError(t, err)
+	require.NoError(t, s.SendData(context.Background(), []odoo.OdooMeteredBillingRecord{{ProductID: "p", InstanceID: "a", SalesOrderID: "SO1"}}))
+	require.NoError(t, closeSinks())
+	require.Equal(t, []string{"application/json, text/plain"}, accept)
+}
+
+// failingOnceClient fails the first delivery and counts the delivered records.
+type failingOnceClient struct {
+	failed    bool
+	delivered int
+}
+
+func (c *failingOnceClient) SendData(_ context.Context, data []odoo.OdooMeteredBillingRecord) error {
+	if !c.failed {
+		c.failed = true
+		return errors.New("odoo is down")
+	}
+	c.delivered += len(data)
+	return nil
+}
+
+func TestSinkFlags_LedgerSkipsSucceededSinks(t *testing.T) {
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.json"))
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	f := &sinkFlags{SinkMode: string(sink.AllMustSucceed)}
+	require.NoError(t, f.Sinks.Set("odoo"))
+	require.NoError(t, f.Sinks.Set("jsonl="+path))
+
+	o := &failingOnceClient{}
+	records := []odoo.OdooMeteredBillingRecord{{ProductID: "p", InstanceID: "a", SalesOrderID: "SO1"}}
+	for range 2 {
+		s, closeSinks, err := f.newSink(logr.Discard(), l, nil, nil, func(config.Odoo) report.OdooClient { return o })
+		require.NoError(t, err)
+		_ = s.SendData(context.Background(), records)
+		require.NoError(t, closeSinks())
+	}
+
+	require.Equal(t, 1, o.delivered)
+	out, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(out), "\n"), "the retry must not deliver the records to the sink that succeeded again")
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/multierr"
+
+	"github.com/appuio/appuio-reporting/pkg/config"
+	"github.com/appuio/appuio-reporting/pkg/report"
+)
+
+const (
+	// validateExitCodeInvalid is the exit code of the validate command if problems were found.
+	validateExitCodeInvalid = 1
+	// validateExitCodeError is the exit code of the validate command if the validation itself failed, for example because Prometheus could not be queried.
+	validateExitCodeError = 2
+)
+
+type validateCommand struct {
+	ConfigFile string
+	Reports    cli.StringSlice
+
+	ReportArgs report.ReportArgs
+	SalesOrder salesOrderFlags
+	Jsonnet    jsonnetFlags
+
+	SampleLabels stringList
+
+	Live                        bool
+	At                          *time.Time
+	PrometheusURL               string
+	ThanosAllowPartialResponses bool
+	OrgId                       string
+}
+
+var validateCommandName = "validate"
+
+func newValidateCommand() *cli.Command {
+	command := &validateCommand{}
+	return &cli.Command{
+		Name:  validateCommandName,
+		Usage: "Check the query and Jsonnet snippets of reports without sending anything",
+		Description: fmt.Sprintf("Validates the report given with flags, or the reports in --config. "+
+			"Exits with %d if all reports are valid, with %d if problems were found and with %d if the validation failed.",
+			0, validateExitCodeInvalid, validateExitCodeError),
+		Before: command.before,
+		Action: command.execute,
+		Flags: slices.Concat([]cli.Flag{
+			&cli.StringFlag{Name: "config", Usage: "Path to the YAML or JSON file containing the report definitions. Validates the reports in the file instead of the report given with flags.",
+				EnvVars: envVars("CONFIG"), Destination: &command.ConfigFile, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringSliceFlag{Name: "report", Usage: "Name of a report in the configuration file to validate. Can be repeated. Validates all reports if not set.",
+				EnvVars: envVars("REPORTS"), Destination: &command.Reports, DefaultText: "all"},
+			&cli.StringFlag{Name: "query", Usage: "Prometheus query to validate. Required without --config.",
+				EnvVars: envVars("QUERY"), Destination: &command.ReportArgs.Query, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "instance-jsonnet", Usage: "Jsonnet snippet that generates the Instance ID. Required without --config.",
+				EnvVars: envVars("INSTANCE_JSONNET"), Destination: &command.ReportArgs.InstanceJsonnet, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "item-group-description-jsonnet", Usage: "Jsonnet snippet that generates the item group description on invoice",
+				EnvVars: envVars("ITEM_GROUP_DESCRIPTION_JSONNET"), Destination: &command.ReportArgs.ItemGroupDescriptionJsonnet, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "item-description-jsonnet", Usage: "Jsonnet snippet that generates the item description on invoice",
+				EnvVars: envVars("ITEM_DESCRIPTION_JSONNET"), Destination: &command.ReportArgs.ItemDescriptionJsonnet, DefaultText: defaultTextForOptionalFlags},
+			newProductIDJsonnetFlag(&command.ReportArgs.ProductIDJsonnet),
+			newUnitIDJsonnetFlag(&command.ReportArgs.UnitIDJsonnet),
+			&cli.GenericFlag{Name: "sample-labels", Usage: `Labels of a sample to evaluate the Jsonnet snippets against, as JSON object (example: {"sales_order":"SO1","namespace":"a"}). Can be repeated.`,
+				EnvVars: envVars("SAMPLE_LABELS"), Value: &command.SampleLabels, DefaultText: defaultTextForOptionalFlags},
+			&cli.BoolFlag{Name: "live", Usage: "Run the queries and evaluate the Jsonnet snippets against the labels of the returned samples",
+				EnvVars: envVars("LIVE"), Destination: &command.Live, DefaultText: "false"},
+			&cli.TimestampFlag{Name: "at", Usage: fmt.Sprintf("Time to run the queries at in --live mode, in the form of RFC3339 (%s)", time.RFC3339),
+				EnvVars: envVars("AT"), Layout: time.RFC3339, DefaultText: "now"},
+			&cli.StringFlag{Name: "prom-url", Usage: "Prometheus connection URL in the form of http://host:port. Only used without --config.",
+				EnvVars: envVars("PROM_URL"), Destination: &command.PrometheusURL, Value: "http://localhost:9090"},
+			&cli.BoolFlag{Name: "thanos-allow-partial-responses", Usage: "Allows partial responses from Thanos. Only used without --config.",
+				EnvVars: envVars("THANOS_ALLOW_PARTIAL_RESPONSES"), Destination: &command.ThanosAllowPartialResponses, DefaultText: "false"},
+			&cli.StringFlag{Name: "org-id", Usage: "Sets the X-Scope-OrgID header to this value on requests to Prometheus. Only used without --config.",
+				EnvVars: envVars("ORG_ID"), Destination: &command.OrgId, DefaultText: "empty"},
+		}, command.SalesOrder.flags(), command.Jsonnet.flags()),
+	}
+}
+
+// before checks the flags. Invalid flags are reported with validateExitCodeError, like other failures of the validation itself,
+// so that CI does not mistake them for problems found in the reports.
+func (cmd *validateCommand) before(context *cli.Context) error {
+	if err := cmd.checkFlags(context); err != nil {
+		return cli.Exit(err, validateExitCodeError)
+	}
+	return LogMetadata(context)
+}
+
+func (cmd *validateCommand) checkFlags(context *cli.Context) error {
+	cmd.At = context.Timestamp("at")
+	if err := cmd.SalesOrder.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	if err := cmd.Jsonnet.apply(&cmd.ReportArgs); err != nil {
+		return err
+	}
+	if cmd.ConfigFile == "" {
+		if err := requireFlags(context, "query"); err != nil {
+			return err
+		}
+		if err := requireInstanceJsonnet(cmd.ReportArgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namedReport is a report to validate.
+type namedReport struct {
+	name string
+	args report.ReportArgs
+}
+
+func (cmd *validateCommand) execute(cliCtx *cli.Context) error {
+	ctx := cliCtx.Context
+	log := AppLogger(ctx).WithName(validateCommandName)
+	out := cliCtx.App.Writer
+
+	labelSets, err := parseSampleLabels(cmd.SampleLabels.Value())
+	if err != nil {
+		return cli.Exit(err, validateExitCodeError)
+	}
+
+	reports := []namedReport{{name: "report", args: cmd.ReportArgs}}
+	promURL, thanosAllow, orgID := cmd.PrometheusURL, cmd.ThanosAllowPartialResponses, cmd.OrgId
+	if cmd.ConfigFile != "" {
+		c, err := config.Load(cmd.ConfigFile)
+		if err != nil {
+			printProblems(out, cmd.ConfigFile, err)
+			return cli.Exit(fmt.Sprintf("%d problems found", len(multierr.Errors(err))), validateExitCodeInvalid)
+		}
+		selected, err := c.Select(cmd.Reports.Value()...)
+		if err != nil {
+			return cli.Exit(err, validateExitCodeError)
+		}
+		reports = make([]namedReport, 0, len(selected))
+		for _, r := range selected {
+			args := r.ReportArgs()
+			args.JsonnetLibraryPaths = slices.Concat(c.JsonnetLibraryPaths, cmd.Jsonnet.LibraryPaths.Value())
+			args.JsonnetExtVars = mergeJsonnetExtVars(args.JsonnetExtVars, cmd.ReportArgs.JsonnetExtVars)
+			reports = append(reports, namedReport{name: r.Name, args: args})
+		}
+		promURL, thanosAllow, orgID = c.Prometheus.URL, c.Prometheus.ThanosAllowPartialResponses, c.Prometheus.OrgID
+	}
+
+	var fetchLabels func(query string) ([]model.Metric, error)
+	if cmd.Live {
+		promClient, err := newPrometheusAPIClient(promURL, thanosAllow, orgID)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("could not create prometheus client: %w", err), validateExitCodeError)
+		}
+		at := time.Now()
+		if cmd.At != nil {
+			at = *cmd.At
+		}
+		fetchLabels = func(query string) ([]model.Metric, error) {
+			return report.SampleLabels(ctx, promClient, query, at)
+		}
+	}
+
+	problems := 0
+	for _, r := range reports {
+		reportLabels := labelSets
+		if fetchLabels != nil && report.ValidateQuery(r.args.Query) == nil {
+			live, err := fetchLabels(r.args.Query)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("%s: %w", r.name, err), validateExitCodeError)
+			}
+			if len(live) == 0 {
+				log.Info("Query returned no samples, Jsonnet snippets are only evaluated against --sample-labels", "report", r.name)
+			}
+			reportLabels = append(append([]model.Metric{}, labelSets...), live...)
+		}
+
+		err := report.Validate(r.args, reportLabels...)
+		if err != nil {
+			printProblems(out, r.name, err)
+			problems += len(multierr.Errors(err))
+			continue
+		}
+		fmt.Fprintf(out, "%s: OK\n", r.name)
+	}
+
+	if problems > 0 {
+		return cli.Exit(fmt.Sprintf("%d problems found", problems), validateExitCodeInvalid)
+	}
+	return nil
+}
+
+// parseSampleLabels parses label sets given as JSON objects.
+func parseSampleLabels(values []string) ([]model.Metric, error) {
+	labelSets := make([]model.Metric, 0, len(values))
+	for _, v := range values {
+		var labels model.Metric
+		if err := json.Unmarshal([]byte(v), &labels); err != nil {
+			return nil, fmt.Errorf("invalid sample labels %q: %w", v, err)
+		}
+		labelSets = append(labelSets, labels)
+	}
+	return labelSets, nil
+}
+
+func printProblems(out io.Writer, name string, err error) {
+	for _, e := range multierr.Errors(err) {
+		fmt.Fprintf(out, "%s: %s\n", name, e)
+	}
+}
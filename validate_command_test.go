@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// runValidate runs the validate command with the given arguments and returns its output and exit code.
+func runValidate(t *testing.T, args ...string) (string, int) {
+	exitCode := 0
+	osExiter := cli.OsExiter
+	cli.OsExiter = func(code int) { exitCode = code }
+	t.Cleanup(func() { cli.OsExiter = osExiter })
+
+	ctx, stop, app := newApp()
+	defer stop()
+	out := &bytes.Buffer{}
+	app.Writer = out
+	app.ErrWriter = &bytes.Buffer{}
+	if err := app.RunContext(ctx, append([]string{appName, "--log-format", "json", validateCommandName}, args...)); err != nil && exitCode == 0 {
+		exitCode = 1
+	}
+	return out.String(), exitCode
+}
+
+func TestValidate_SampleLabelsWithMultipleLabels(t *testing.T) {
+	out, exitCode := runValidate(t,
+		"--query", "sum by (sales_order, namespace) (usage)",
+		"--instance-jsonnet", `local labels = std.extVar("labels"); labels.namespace`,
+		"--sales-order-jsonnet", `local labels = std.extVar("labels"); labels.sales_order`,
+		"--sample-labels", `{"sales_order":"SO1","namespace":"a"}`,
+		"--sample-labels", `{"sales_order":"SO2","namespace":"b"}`,
+	)
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "report: OK\n", out)
+
+	out, exitCode = runValidate(t,
+		"--query", "sum by (sales_order, namespace) (usage)",
+		"--instance-jsonnet", `local labels = std.extVar("labels"); labels.namespace`,
+		"--sales-order-jsonnet", `local labels = std.extVar("labels"); labels.sales_order`,
+		"--sample-labels", `{"sales_order":"SO1"}`,
+	)
+	require.Equal(t, validateExitCodeInvalid, exitCode)
+	require.Contains(t, out, "namespace")
+}
+
+func TestValidate_InvalidFlagsExitWithErrorCode(t *testing.T) {
+	_, exitCode := runValidate(t, "--instance-jsonnet", `"instance"`)
+	require.Equal(t, validateExitCodeError, exitCode)
+}
+
+func TestValidate_JsonnetExtVarWithComma(t *testing.T) {
+	out, exitCode := runValidate(t,
+		"--query", "sum by (sales_order) (usage)",
+		"--instance-jsonnet", `assert std.extVar("desc") == "Storage, per GB"; "instance"`,
+		"--jsonnet-ext-var", "desc=Storage, per GB",
+		"--sample-labels", `{"sales_order":"SO1"}`,
+	)
+	require.Equal(t, 0, exitCode, out)
+	require.Equal(t, "report: OK\n", out)
+}